@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dormsystem/db"
+	"dormsystem/handlers"
+)
+
+func runCommand(name string, args []string) int {
+	switch name {
+	case "bootstrap":
+		return runBootstrap(args)
+	case "repair-buildings":
+		return runRepairBuildings(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		fmt.Fprintln(os.Stderr, "commands: bootstrap, genkey, migrate, repair-buildings")
+		return 2
+	}
+}
+
+// runBootstrap creates the first admin account on an empty system.
+func runBootstrap(args []string) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	username := fs.String("username", "admin", "admin login name")
+	name := fs.String("name", "管理员", "admin display name")
+	password := fs.String("password", "", "initial password, generated when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	pw, err := handlers.BootstrapAdmin(*username, *name, *password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bootstrap failed:", err)
+		return 1
+	}
+	fmt.Printf("admin %q created\n", *username)
+	if *password == "" {
+		fmt.Printf("initial password: %s\n", pw)
+	}
+	fmt.Println("the password must be changed on first login")
+	return 0
+}
+
+// runMigrate handles migrate up, migrate down [-steps n] and migrate status.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up | down [-steps n] | status")
+		return 2
+	}
+	switch args[0] {
+	case "up":
+		done, err := db.MigrateUp()
+		for _, m := range done {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate up failed:", err)
+			return 1
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return 0
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		steps := fs.Int("steps", 1, "number of migrations to roll back")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		done, err := db.MigrateDown(*steps)
+		for _, m := range done {
+			fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate down failed:", err)
+			return 1
+		}
+		return 0
+	case "status":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate status failed:", err)
+			return 1
+		}
+		code := 0
+		for _, st := range states {
+			state := "pending"
+			if st.AppliedAt != nil {
+				state = "applied " + st.AppliedAt.Format(time.RFC3339)
+			}
+			if st.Problem != "" {
+				state = "BROKEN: " + st.Problem
+				code = 1
+			}
+			fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, state)
+		}
+		return code
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+}
+
+// runRepairBuildings reports current students whose building differs from
+// their room's and, unless -dry-run is given, fixes them.
+func runRepairBuildings(args []string) int {
+	fs := flag.NewFlagSet("repair-buildings", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report the drifted rows")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	drift, err := db.FindBuildingDrift()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check failed:", err)
+		return 1
+	}
+	for _, d := range drift {
+		fmt.Printf("%s %d: building %d, room %d is in building %d\n",
+			d.TableName, d.ID, d.BuildingID, d.RoomID, d.RoomBuildingID)
+	}
+	if len(drift) == 0 {
+		fmt.Println("no drift found")
+		return 0
+	}
+	if *dryRun {
+		fmt.Printf("%d rows would be repaired\n", len(drift))
+		return 0
+	}
+	fixed, err := db.RepairBuildingDrift()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "repair failed:", err)
+		return 1
+	}
+	fmt.Printf("%d rows repaired\n", fixed)
+	return 0
+}
+
+// runGenKey writes a new JWT signing key to <dir>/<kid>.pem. Kids default to
+// a timestamp so the newest key sorts last and becomes the active one.
+func runGenKey(args []string) int {
+	fs := flag.NewFlagSet("genkey", flag.ContinueOnError)
+	alg := fs.String("alg", "EdDSA", "EdDSA or RS256")
+	dir := fs.String("dir", "keys", "key directory")
+	kid := fs.String("kid", time.Now().UTC().Format("20060102T150405Z"), "key id")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var key interface{}
+	var err error
+	switch *alg {
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported algorithm %q\n", *alg)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "genkey failed:", err)
+		return 1
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "genkey failed:", err)
+		return 1
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		fmt.Fprintln(os.Stderr, "genkey failed:", err)
+		return 1
+	}
+	path := filepath.Join(*dir, *kid+".pem")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "genkey failed:", err)
+		return 1
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		fmt.Fprintln(os.Stderr, "genkey failed:", err)
+		return 1
+	}
+	fmt.Println("wrote", path)
+	return 0
+}
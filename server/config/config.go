@@ -1,11 +1,75 @@
 package config
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultJWTSecret = "change-this-secret"
+
+// Proration granularities for accommodation fees.
+const (
+	ProrateDaily     = "daily"
+	ProrateHalfMonth = "half-month"
+	ProrateMonthly   = "monthly"
+)
 
 type Config struct {
+	// Env is "development" or "production".
+	Env       string
 	DBUrl     string
 	JWTSecret string
-	HTTPPort  string
+	// JWTPreviousSecrets still verify HS256 tokens after the secret rotates.
+	JWTPreviousSecrets []string
+	// JWTAlgorithm is HS256, RS256 or EdDSA. The asymmetric algorithms read
+	// PEM private keys named <kid>.pem from JWTKeyDir.
+	JWTAlgorithm    string
+	JWTKeyDir       string
+	JWTActiveKID    string
+	HTTPPort        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// MaxLoginAttempts failed logins lock an account for LockoutDuration.
+	MaxLoginAttempts int
+	LockoutDuration  time.Duration
+	// LoginRateLimit is the number of login requests one IP may make per
+	// minute.
+	LoginRateLimit int
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For is
+	// believed when working out the client IP. By default none are, so the
+	// IP is the address the connection came from.
+	TrustedProxies []string
+	// PasswordMinClasses is how many of lower case, upper case, digits and
+	// other characters a password must contain.
+	PasswordMinLength  int
+	PasswordMinClasses int
+	// TOTPRequiredRoles must enroll in two-factor authentication before they
+	// can use the API.
+	TOTPRequiredRoles []string
+	TOTPIssuer        string
+	// CORSCredentialOrigins is the subset of CORSAllowedOrigins that may send
+	// cookies and Authorization headers. "*" allows any origin without
+	// credentials.
+	CORSAllowedOrigins    []string
+	CORSCredentialOrigins []string
+	CORSAllowedMethods    []string
+	CORSAllowedHeaders    []string
+	CORSExposedHeaders    []string
+	// SecurityHeaders turns on HSTS, frame and content type options and CSP.
+	SecurityHeaders       bool
+	HSTSMaxAge            int
+	ContentSecurityPolicy string
+	// WebDir, when set, is the built SPA served next to the API.
+	WebDir string
+	// TrashRetention is how long soft-deleted rows are kept before purging.
+	TrashRetention time.Duration
+	// Proration is how finely accommodation fees follow a student's days in
+	// a room: daily, half-month or monthly.
+	Proration string
 }
 
 func Load() Config {
@@ -15,16 +79,142 @@ func Load() Config {
 	}
 	secret := os.Getenv("DORM_JWT_SECRET")
 	if secret == "" {
-		secret = "change-this-secret"
+		secret = DefaultJWTSecret
 	}
 	port := os.Getenv("DORM_HTTP_PORT")
 	if port == "" {
 		port = ":8080"
 	}
+	issuer := os.Getenv("DORM_TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "DormSystem"
+	}
+	proration := os.Getenv("DORM_PRORATION")
+	if proration == "" {
+		proration = ProrateDaily
+	}
+	env := os.Getenv("DORM_ENV")
+	if env == "" {
+		env = "development"
+	}
+	alg := os.Getenv("DORM_JWT_ALG")
+	if alg == "" {
+		alg = "HS256"
+	}
+	origins := listEnv("DORM_CORS_ORIGINS", []string{"http://localhost:3000"})
+	csp := os.Getenv("DORM_CSP")
+	if csp == "" {
+		csp = "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; " +
+			"connect-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+	}
 	return Config{
-		DBUrl:     dbUrl,
-		JWTSecret: secret,
-		HTTPPort:  port,
+		Env:                env,
+		JWTPreviousSecrets: listEnv("DORM_JWT_PREVIOUS_SECRETS", nil),
+		JWTAlgorithm:       alg,
+		JWTKeyDir:          os.Getenv("DORM_JWT_KEY_DIR"),
+		JWTActiveKID:       os.Getenv("DORM_JWT_ACTIVE_KID"),
+		DBUrl:              dbUrl,
+		JWTSecret:          secret,
+		HTTPPort:           port,
+		AccessTokenTTL:     durationEnv("DORM_ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:    durationEnv("DORM_REFRESH_TOKEN_TTL", 7*24*time.Hour),
+		MaxLoginAttempts:   intEnv("DORM_MAX_LOGIN_ATTEMPTS", 5),
+		LockoutDuration:    durationEnv("DORM_LOCKOUT_DURATION", 15*time.Minute),
+		LoginRateLimit:     intEnv("DORM_LOGIN_RATE_LIMIT", 20),
+		TrustedProxies:     listEnv("DORM_TRUSTED_PROXIES", nil),
+		PasswordMinLength:  intEnv("DORM_PASSWORD_MIN_LENGTH", 8),
+		PasswordMinClasses: intEnv("DORM_PASSWORD_MIN_CLASSES", 3),
+		TOTPRequiredRoles:  listEnv("DORM_TOTP_REQUIRED_ROLES", []string{"admin", "finance"}),
+		TOTPIssuer:         issuer,
+
+		CORSAllowedOrigins:    origins,
+		CORSCredentialOrigins: listEnv("DORM_CORS_CREDENTIAL_ORIGINS", origins),
+		CORSAllowedMethods:    listEnv("DORM_CORS_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+		CORSAllowedHeaders:    listEnv("DORM_CORS_HEADERS", []string{"Content-Type", "Authorization", "If-Match", "If-None-Match"}),
+		CORSExposedHeaders:    listEnv("DORM_CORS_EXPOSED_HEADERS", []string{"ETag"}),
+		SecurityHeaders:       boolEnv("DORM_SECURITY_HEADERS", env == "production"),
+		HSTSMaxAge:            intEnv("DORM_HSTS_MAX_AGE", 31536000),
+		ContentSecurityPolicy: csp,
+		WebDir:                os.Getenv("DORM_WEB_DIR"),
+		TrashRetention:        durationEnv("DORM_TRASH_RETENTION", 30*24*time.Hour),
+		Proration:             proration,
+	}
+}
+
+// Validate rejects settings the server cannot work with and ones that must
+// never reach production.
+func (c Config) Validate() error {
+	switch c.Proration {
+	case ProrateDaily, ProrateHalfMonth, ProrateMonthly:
+	default:
+		return fmt.Errorf("DORM_PRORATION must be daily, half-month or monthly, not %q", c.Proration)
+	}
+	if c.Env != "production" || c.JWTAlgorithm != "HS256" {
+		return nil
+	}
+	if c.JWTSecret == DefaultJWTSecret {
+		return errors.New("DORM_JWT_SECRET must be set in production")
+	}
+	if len(c.JWTSecret) < 32 {
+		return errors.New("DORM_JWT_SECRET must be at least 32 characters in production")
+	}
+	// A weak previous secret still verifies tokens, so it is as dangerous.
+	for i, s := range c.JWTPreviousSecrets {
+		if s == DefaultJWTSecret {
+			return fmt.Errorf("DORM_JWT_PREVIOUS_SECRETS entry %d is the default secret", i+1)
+		}
+		if len(s) < 32 {
+			return fmt.Errorf("DORM_JWT_PREVIOUS_SECRETS entry %d must be at least 32 characters in production", i+1)
+		}
 	}
+	return nil
 }
 
+// listEnv reads a comma separated list. Setting the variable to "none"
+// yields an empty list.
+func listEnv(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && item != "none" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func boolEnv(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func intEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
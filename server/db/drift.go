@@ -0,0 +1,32 @@
+package db
+
+// BuildingDrift is a current student whose building_id differs from the
+// building of their room. Checked-out students and the ledger keep the
+// building they had when they were written, so they never drift.
+type BuildingDrift struct {
+	TableName      string
+	ID             uint
+	BuildingID     uint
+	RoomID         uint
+	RoomBuildingID uint
+}
+
+// FindBuildingDrift lists the drifted rows.
+func FindBuildingDrift() ([]BuildingDrift, error) {
+	var list []BuildingDrift
+	err := DB.Raw(`
+select 'students' as table_name, s.id, s.building_id, s.room_id, r.building_id as room_building_id
+from students s join dorm_rooms r on r.id = s.room_id
+where s.deleted_at is null and s.building_id is distinct from r.building_id
+order by 2`).Scan(&list).Error
+	return list, err
+}
+
+// RepairBuildingDrift copies each room's building onto its current students
+// and returns the number of rows changed.
+func RepairBuildingDrift() (int64, error) {
+	res := DB.Exec(`update students s set building_id = r.building_id
+from dorm_rooms r
+where r.id = s.room_id and s.deleted_at is null and s.building_id is distinct from r.building_id`)
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migrations live in migrations/ as NNNN_name.up.sql and NNNN_name.down.sql.
+// They run in version order, each in its own transaction, and are recorded
+// in schema_migrations with the checksum of the up file. Applied migrations
+// must never be edited; add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLock serializes concurrent migrate runs.
+const migrationLock = 7215001
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationState is one line of migrate status. Problem is set when an
+// applied migration no longer matches its file or has no file at all.
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Problem   string
+}
+
+type schemaMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+			sum := sha256.Sum256(body)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	list := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		list = append(list, *mig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+func ensureMigrationTable(tx *gorm.DB) error {
+	return tx.Exec(`create table if not exists schema_migrations (
+  version integer primary key,
+  name text not null,
+  checksum char(64) not null,
+  applied_at timestamptz not null default now()
+)`).Error
+}
+
+func appliedMigrations(tx *gorm.DB) (map[int]schemaMigration, error) {
+	if err := ensureMigrationTable(tx); err != nil {
+		return nil, err
+	}
+	var rows []schemaMigration
+	if err := tx.Table("schema_migrations").Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := map[int]schemaMigration{}
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// MigrationStatus lists every known or applied migration in version order.
+func MigrationStatus() ([]MigrationState, error) {
+	list, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(DB)
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, m := range list {
+		st := MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			at := a.AppliedAt
+			st.AppliedAt = &at
+			if a.Checksum != m.Checksum {
+				st.Problem = "checksum mismatch: the file changed after it was applied"
+			}
+			delete(applied, m.Version)
+		}
+		states = append(states, st)
+	}
+	for _, a := range applied {
+		at := a.AppliedAt
+		states = append(states, MigrationState{
+			Version: a.Version, Name: a.Name, AppliedAt: &at,
+			Problem: "applied but no migration file",
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// CheckMigrations fails when a migration is pending or an applied one does
+// not match its file. The server refuses to start in either case.
+func CheckMigrations() error {
+	return checkMigrations(true)
+}
+
+func checkMigrations(failOnPending bool) error {
+	states, err := MigrationStatus()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, st := range states {
+		if st.Problem != "" {
+			return fmt.Errorf("migration %04d_%s: %s", st.Version, st.Name, st.Problem)
+		}
+		if st.AppliedAt == nil {
+			pending++
+		}
+	}
+	if failOnPending && pending > 0 {
+		return fmt.Errorf("%d pending migrations, run \"migrate up\"", pending)
+	}
+	return nil
+}
+
+// MigrateUp applies every pending migration and returns those it applied.
+func MigrateUp() ([]Migration, error) {
+	if err := checkMigrations(false); err != nil {
+		return nil, err
+	}
+	list, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range list {
+		ran := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("select pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+			applied, err := appliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := applied[m.Version]; ok {
+				return nil
+			}
+			if err := tx.Exec(m.Up).Error; err != nil {
+				return err
+			}
+			ran = true
+			return tx.Exec("insert into schema_migrations (version, name, checksum) values (?, ?, ?)",
+				m.Version, m.Name, m.Checksum).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back the last steps applied migrations and returns
+// those it rolled back.
+func MigrateDown(steps int) ([]Migration, error) {
+	if err := checkMigrations(false); err != nil {
+		return nil, err
+	}
+	list, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(list) - 1; i >= 0 && len(done) < steps; i-- {
+		m := list[i]
+		ran := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("select pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+			applied, err := appliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := applied[m.Version]; !ok {
+				return nil
+			}
+			if err := tx.Exec(m.Down).Error; err != nil {
+				return err
+			}
+			ran = true
+			return tx.Exec("delete from schema_migrations where version = ?", m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// released pins the checksum of every migration that may have been applied
+// somewhere. Editing one of them makes CheckMigrations refuse to start, so
+// add a new migration instead and list it here.
+var released = map[int]string{
+	1:  "a070afe930de2249fe782976b71e14764b5ca9cb246f8769b75576732f711192",
+	2:  "42b0acd94f2523778ead7e7d43cbc73e09697ec18f3a59ef45dfafc7f7210cd5",
+	3:  "ee23b4c3af66154968734270424534541423b4c5637814205111560b6d0a7a30",
+	4:  "384c74993568aa8333bd2b1256270989b5854d30ebe423358bd73bec353e8b0d",
+	5:  "de1e00415d571d69f416a271aae7eb986936a285960f0f869df22ddba4ad8ebe",
+	6:  "fd8561776fd48f0af3937ad2f19053b421ac848a10fce6f09db1eaa82c7ccc0f",
+	7:  "494066b64913ae3e5eb5f898ecde9e9758500cf08cb799aede275521ce47ce5e",
+	8:  "3153fa92a125bb9f6c930662237375f1305b566b62aef41268e6aeebdc01fe11",
+	9:  "7845a93e160c7b1c539937f4ed73db4710311b006b69fd823499c964eda5a2f4",
+	10: "35e6378b7a87351f30ae058db85ba2229cfea3a8749d7e1b0710a0f31b5d69c7",
+	11: "e67ac13957509c756fcfdab5ea5fc2c3e68a1d98bf0db2564ff16b0ed3f71715",
+	12: "29485ac092e4686359b3f196014710cb3fcab1019e75f62822b54e2862c44af0",
+	13: "c6fae6fe9aae46384050f9ef3ff565aaadec62be21a5963bc0d9a372c30b31fb",
+	14: "303648dcfe10495af7ae85f911a984e227eba281d1dc9efdf233fd5287d9abaa",
+	15: "2d7a6833ba25ee7a0288862907848f3f05e370056d8c3e6d8c0fb9174e254e24",
+}
+
+func TestLoadMigrationsOrder(t *testing.T) {
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Fatal("no migrations")
+	}
+	for i, m := range list {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d is %04d_%s, want version %d; versions must have no gaps", i, m.Version, m.Name, i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("%04d_%s is missing its up or down file", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsChecksums(t *testing.T) {
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range list {
+		sum := sha256.Sum256([]byte(m.Up))
+		if got := hex.EncodeToString(sum[:]); got != m.Checksum {
+			t.Errorf("%04d_%s: checksum %s is not that of the up file (%s)", m.Version, m.Name, m.Checksum, got)
+		}
+		want, ok := released[m.Version]
+		if !ok {
+			t.Errorf("%04d_%s is not listed in released; add it with checksum %s", m.Version, m.Name, m.Checksum)
+			continue
+		}
+		if m.Checksum != want {
+			t.Errorf("%04d_%s was edited after release: checksum %s, want %s", m.Version, m.Name, m.Checksum, want)
+		}
+	}
+	if len(released) != len(list) {
+		t.Errorf("released lists %d migrations, found %d files", len(released), len(list))
+	}
+}
@@ -0,0 +1,10 @@
+drop trigger if exists trg_check_room_capacity_update on students;
+drop trigger if exists trg_check_room_capacity_insert on students;
+drop function if exists check_room_capacity();
+drop view if exists v_building_payment_summary;
+drop view if exists v_building_occupancy;
+drop table if exists users;
+drop table if exists payments;
+drop table if exists students;
+drop table if exists dorm_rooms;
+drop table if exists apartment_buildings;
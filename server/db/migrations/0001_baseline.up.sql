@@ -0,0 +1,176 @@
+-- Tables and schema objects as AutoMigrate and applySchemaObjects left
+-- them before versioned migrations, so existing databases pass through
+-- this migration unchanged. Columns added since come in later migrations.
+create table if not exists apartment_buildings (
+  id bigserial primary key,
+  building_no varchar(20) not null,
+  floor_count bigint not null,
+  room_count bigint not null,
+  started_at date not null
+);
+create unique index if not exists idx_apartment_buildings_building_no on apartment_buildings (building_no);
+
+create table if not exists dorm_rooms (
+  id bigserial primary key,
+  room_no varchar(20) not null,
+  capacity bigint not null,
+  fee decimal,
+  phone varchar(20),
+  building_id bigint not null,
+  constraint fk_apartment_buildings_rooms foreign key (building_id) references apartment_buildings(id)
+);
+create index if not exists idx_dorm_rooms_building_id on dorm_rooms (building_id);
+
+create table if not exists students (
+  id bigserial primary key,
+  student_no varchar(20) not null,
+  name varchar(50) not null,
+  gender varchar(10),
+  ethnicity varchar(20),
+  major varchar(100),
+  class_name varchar(50),
+  phone varchar(20),
+  building_id bigint,
+  room_id bigint,
+  constraint fk_students_building foreign key (building_id) references apartment_buildings(id)
+    on delete set null on update cascade,
+  constraint fk_dorm_rooms_students foreign key (room_id) references dorm_rooms(id)
+);
+create index if not exists idx_students_room_id on students (room_id);
+create index if not exists idx_students_building_id on students (building_id);
+create unique index if not exists idx_students_student_no on students (student_no);
+
+create table if not exists payments (
+  id bigserial primary key,
+  payment_no varchar(50) not null,
+  building_id bigint not null,
+  room_id bigint not null,
+  student_id bigint,
+  paid_at date not null,
+  payment_type varchar(50) not null,
+  amount decimal not null,
+  constraint fk_students_payments foreign key (student_id) references students(id),
+  constraint fk_dorm_rooms_payments foreign key (room_id) references dorm_rooms(id),
+  constraint fk_payments_building foreign key (building_id) references apartment_buildings(id)
+    on delete restrict on update cascade
+);
+create index if not exists idx_payments_student_id on payments (student_id);
+create index if not exists idx_payments_room_id on payments (room_id);
+create index if not exists idx_payments_building_id on payments (building_id);
+create unique index if not exists idx_payments_payment_no on payments (payment_no);
+
+create table if not exists users (
+  id bigserial primary key,
+  username varchar(50) not null,
+  name varchar(50) not null,
+  password_hash varchar(200) not null,
+  role varchar(20) not null,
+  created_at timestamptz
+);
+create unique index if not exists idx_users_username on users (username);
+
+-- Older databases stored dates as text.
+do $$
+begin
+if exists (
+  select 1 from information_schema.columns
+  where table_name = 'apartment_buildings'
+    and column_name = 'started_at'
+    and data_type <> 'date'
+) then
+  update apartment_buildings set started_at = null where started_at = '';
+  alter table apartment_buildings
+    alter column started_at type date using started_at::date;
+end if;
+if exists (
+  select 1 from information_schema.columns
+  where table_name = 'payments'
+    and column_name = 'paid_at'
+    and data_type <> 'date'
+) then
+  update payments set paid_at = null where paid_at = '';
+  alter table payments
+    alter column paid_at type date using paid_at::date;
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_building_floor_count') then
+  alter table apartment_buildings add constraint chk_building_floor_count check (floor_count > 0);
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_building_room_count') then
+  alter table apartment_buildings add constraint chk_building_room_count check (room_count >= 0);
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_room_capacity') then
+  alter table dorm_rooms add constraint chk_room_capacity check (capacity > 0);
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_room_fee_nonnegative') then
+  alter table dorm_rooms add constraint chk_room_fee_nonnegative check (fee >= 0);
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_student_gender') then
+  alter table students add constraint chk_student_gender check (gender in ('男','女'));
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_payment_amount') then
+  alter table payments add constraint chk_payment_amount check (amount > 0);
+end if;
+if not exists (select 1 from pg_constraint where conname = 'chk_payment_type') then
+  alter table payments add constraint chk_payment_type check (payment_type in ('住宿费','水电费','押金'));
+end if;
+end
+$$;
+create or replace view v_building_occupancy as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(r.capacity), 0) as total_capacity,
+  count(s.id) as occupied_beds,
+  case
+    when coalesce(sum(r.capacity), 0) = 0 then 0
+    else round(count(s.id) * 100.0 / sum(r.capacity), 2)
+  end as occupancy_rate
+from apartment_buildings b
+left join dorm_rooms r on r.building_id = b.id
+left join students s on s.room_id = r.id
+group by b.id, b.building_no;
+create or replace view v_building_payment_summary as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(p.amount), 0) as total_amount
+from apartment_buildings b
+left join payments p on p.building_id = b.id
+group by b.id, b.building_no;
+create or replace function check_room_capacity()
+returns trigger as $$
+declare
+  room_capacity int;
+  current_count int;
+begin
+  if new.room_id is null then
+    return new;
+  end if;
+  select capacity into room_capacity from dorm_rooms where id = new.room_id;
+  if room_capacity is null then
+    raise exception '寝室不存在';
+  end if;
+  if tg_op = 'INSERT' then
+    select count(*) into current_count from students where room_id = new.room_id;
+  elsif tg_op = 'UPDATE' then
+    if new.room_id = old.room_id then
+      return new;
+    end if;
+    select count(*) into current_count from students where room_id = new.room_id;
+  else
+    return new;
+  end if;
+  if current_count >= room_capacity then
+    raise exception '寝室人数已满';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_check_room_capacity_insert on students;
+create trigger trg_check_room_capacity_insert
+before insert on students
+for each row execute function check_room_capacity();
+drop trigger if exists trg_check_room_capacity_update on students;
+create trigger trg_check_room_capacity_update
+before update on students
+for each row execute function check_room_capacity();
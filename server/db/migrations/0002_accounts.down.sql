@@ -0,0 +1,14 @@
+drop table if exists audit_logs;
+drop table if exists api_keys;
+drop table if exists login_challenges;
+drop table if exists recovery_codes;
+drop table if exists user_buildings;
+drop table if exists revoked_tokens;
+drop table if exists refresh_tokens;
+alter table users drop column if exists service_account;
+alter table users drop column if exists totp_last_step;
+alter table users drop column if exists totp_enabled;
+alter table users drop column if exists totp_secret;
+alter table users drop column if exists locked_until;
+alter table users drop column if exists failed_login_count;
+alter table users drop column if exists must_change_password;
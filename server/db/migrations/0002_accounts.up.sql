@@ -0,0 +1,101 @@
+-- Columns and tables for accounts added since the baseline: forced
+-- password changes, lockout, two-factor sign-in, service accounts,
+-- refresh tokens, building scopes, API keys and the audit log.
+alter table users add column if not exists must_change_password boolean not null default false;
+alter table users add column if not exists failed_login_count bigint not null default 0;
+alter table users add column if not exists locked_until timestamptz;
+alter table users add column if not exists totp_secret varchar(64);
+alter table users add column if not exists totp_enabled boolean not null default false;
+alter table users add column if not exists totp_last_step bigint not null default 0;
+alter table users add column if not exists service_account boolean not null default false;
+
+create table if not exists refresh_tokens (
+  id bigserial primary key,
+  user_id bigint not null,
+  token_hash varchar(64) not null,
+  access_jti varchar(64),
+  expires_at timestamptz not null,
+  revoked_at timestamptz,
+  created_at timestamptz,
+  constraint fk_refresh_tokens_user foreign key (user_id) references users(id)
+    on delete cascade on update cascade
+);
+create index if not exists idx_refresh_tokens_access_jti on refresh_tokens (access_jti);
+create unique index if not exists idx_refresh_tokens_token_hash on refresh_tokens (token_hash);
+create index if not exists idx_refresh_tokens_user_id on refresh_tokens (user_id);
+
+create table if not exists revoked_tokens (
+  jti varchar(64) primary key,
+  expires_at timestamptz not null
+);
+create index if not exists idx_revoked_tokens_expires_at on revoked_tokens (expires_at);
+
+create table if not exists user_buildings (
+  user_id bigint,
+  building_id bigint,
+  primary key (user_id, building_id),
+  constraint fk_user_buildings_user foreign key (user_id) references users(id)
+    on delete cascade on update cascade,
+  constraint fk_user_buildings_building foreign key (building_id) references apartment_buildings(id)
+    on delete cascade on update cascade
+);
+create index if not exists idx_user_buildings_building_id on user_buildings (building_id);
+
+create table if not exists recovery_codes (
+  id bigserial primary key,
+  user_id bigint not null,
+  code_hash varchar(64) not null,
+  used_at timestamptz,
+  created_at timestamptz,
+  constraint fk_recovery_codes_user foreign key (user_id) references users(id)
+    on delete cascade on update cascade
+);
+create index if not exists idx_recovery_codes_user_id on recovery_codes (user_id);
+
+create table if not exists login_challenges (
+  id bigserial primary key,
+  user_id bigint not null,
+  token_hash varchar(64) not null,
+  attempts bigint not null default 0,
+  expires_at timestamptz not null,
+  constraint fk_login_challenges_user foreign key (user_id) references users(id)
+    on delete cascade on update cascade
+);
+create unique index if not exists idx_login_challenges_token_hash on login_challenges (token_hash);
+create index if not exists idx_login_challenges_user_id on login_challenges (user_id);
+
+create table if not exists api_keys (
+  id bigserial primary key,
+  user_id bigint not null,
+  name varchar(100) not null,
+  prefix varchar(20) not null,
+  key_hash varchar(64) not null,
+  scopes varchar(500) not null,
+  expires_at timestamptz,
+  last_used_at timestamptz,
+  revoked_at timestamptz,
+  created_at timestamptz,
+  constraint fk_api_keys_user foreign key (user_id) references users(id)
+    on delete cascade on update cascade
+);
+create index if not exists idx_api_keys_user_id on api_keys (user_id);
+create unique index if not exists idx_api_keys_key_hash on api_keys (key_hash);
+
+create table if not exists audit_logs (
+  id bigserial primary key,
+  user_id bigint,
+  username varchar(50),
+  action varchar(20) not null,
+  entity_type varchar(30) not null,
+  entity_id bigint,
+  before jsonb,
+  after jsonb,
+  ip varchar(64),
+  request_id varchar(64),
+  created_at timestamptz
+);
+create index if not exists idx_audit_logs_created_at on audit_logs (created_at);
+create index if not exists idx_audit_logs_request_id on audit_logs (request_id);
+create index if not exists idx_audit_entity on audit_logs (entity_type, entity_id);
+create index if not exists idx_audit_logs_action on audit_logs (action);
+create index if not exists idx_audit_logs_user_id on audit_logs (user_id);
@@ -0,0 +1,14 @@
+create unique index if not exists idx_apartment_buildings_building_no on apartment_buildings (building_no);
+create unique index if not exists idx_students_student_no on students (student_no);
+create unique index if not exists idx_payments_payment_no on payments (payment_no);
+drop index if exists idx_payments_payment_no_active;
+drop index if exists idx_students_student_no_active;
+drop index if exists idx_buildings_building_no_active;
+alter table payments drop column if exists deleted_at;
+alter table payments drop column if exists version;
+alter table students drop column if exists deleted_at;
+alter table students drop column if exists version;
+alter table dorm_rooms drop column if exists deleted_at;
+alter table dorm_rooms drop column if exists version;
+alter table apartment_buildings drop column if exists deleted_at;
+alter table apartment_buildings drop column if exists version;
@@ -0,0 +1,28 @@
+-- Optimistic locking and soft delete. The column defaults backfill
+-- existing rows; the explicit updates cover columns an earlier AutoMigrate
+-- added without one.
+alter table apartment_buildings add column if not exists version bigint not null default 1;
+alter table apartment_buildings add column if not exists deleted_at timestamptz;
+alter table dorm_rooms add column if not exists version bigint not null default 1;
+alter table dorm_rooms add column if not exists deleted_at timestamptz;
+alter table students add column if not exists version bigint not null default 1;
+alter table students add column if not exists deleted_at timestamptz;
+alter table payments add column if not exists version bigint not null default 1;
+alter table payments add column if not exists deleted_at timestamptz;
+update apartment_buildings set version = 1 where version is null;
+update dorm_rooms set version = 1 where version is null;
+update students set version = 1 where version is null;
+update payments set version = 1 where version is null;
+
+create index if not exists idx_apartment_buildings_deleted_at on apartment_buildings (deleted_at);
+create index if not exists idx_dorm_rooms_deleted_at on dorm_rooms (deleted_at);
+create index if not exists idx_students_deleted_at on students (deleted_at);
+create index if not exists idx_payments_deleted_at on payments (deleted_at);
+
+-- Numbers only have to be unique among rows not in the trash.
+create unique index if not exists idx_buildings_building_no_active on apartment_buildings (building_no) where deleted_at is null;
+create unique index if not exists idx_students_student_no_active on students (student_no) where deleted_at is null;
+create unique index if not exists idx_payments_payment_no_active on payments (payment_no) where deleted_at is null;
+drop index if exists idx_apartment_buildings_building_no;
+drop index if exists idx_students_student_no;
+drop index if exists idx_payments_payment_no;
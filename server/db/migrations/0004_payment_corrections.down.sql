@@ -0,0 +1,10 @@
+alter table payments drop constraint if exists fk_payments_reversal_of;
+alter table payments drop constraint if exists chk_payment_status;
+alter table payments drop constraint if exists chk_payment_amount_sign;
+delete from payments where reversal_of_id is not null;
+alter table payments add constraint chk_payment_amount check (amount > 0);
+drop index if exists idx_payments_reversal_of_id;
+alter table payments drop column if exists reversal_of_id;
+alter table payments drop column if exists voided_at;
+alter table payments drop column if exists reason;
+alter table payments drop column if exists status;
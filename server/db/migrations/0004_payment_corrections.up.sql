@@ -0,0 +1,21 @@
+-- Payments are voided or reversed instead of edited. Existing payments
+-- were all posted.
+alter table payments add column if not exists status varchar(20) not null default 'posted';
+alter table payments add column if not exists reason varchar(200);
+alter table payments add column if not exists voided_at timestamptz;
+alter table payments add column if not exists reversal_of_id bigint;
+update payments set status = 'posted' where status is null or status = '';
+
+create unique index if not exists idx_payments_reversal_of_id on payments (reversal_of_id);
+
+-- A reversal carries the negative amount of the payment it reverses.
+alter table payments drop constraint if exists chk_payment_amount;
+alter table payments drop constraint if exists chk_payment_amount_sign;
+alter table payments add constraint chk_payment_amount_sign check (
+  (reversal_of_id is null and amount > 0) or (reversal_of_id is not null and amount < 0)
+);
+alter table payments drop constraint if exists chk_payment_status;
+alter table payments add constraint chk_payment_status check (status in ('posted','voided','reversed'));
+alter table payments drop constraint if exists fk_payments_reversal_of;
+alter table payments add constraint fk_payments_reversal_of
+  foreign key (reversal_of_id) references payments(id) on delete restrict;
@@ -0,0 +1,69 @@
+drop trigger if exists trg_move_room_occupants on dorm_rooms;
+drop function if exists move_room_occupants();
+drop trigger if exists trg_payments_building on payments;
+drop trigger if exists trg_students_building on students;
+drop function if exists derive_building_from_room();
+drop trigger if exists trg_protect_posted_payment on payments;
+drop function if exists protect_posted_payment();
+-- Back to the views and capacity check of the baseline.
+drop view if exists v_building_payment_summary;
+drop view if exists v_building_occupancy;
+create or replace view v_building_occupancy as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(r.capacity), 0) as total_capacity,
+  count(s.id) as occupied_beds,
+  case
+    when coalesce(sum(r.capacity), 0) = 0 then 0
+    else round(count(s.id) * 100.0 / sum(r.capacity), 2)
+  end as occupancy_rate
+from apartment_buildings b
+left join dorm_rooms r on r.building_id = b.id
+left join students s on s.room_id = r.id
+group by b.id, b.building_no;
+create or replace view v_building_payment_summary as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(p.amount), 0) as total_amount
+from apartment_buildings b
+left join payments p on p.building_id = b.id
+group by b.id, b.building_no;
+create or replace function check_room_capacity()
+returns trigger as $$
+declare
+  room_capacity int;
+  current_count int;
+begin
+  if new.room_id is null then
+    return new;
+  end if;
+  select capacity into room_capacity from dorm_rooms where id = new.room_id;
+  if room_capacity is null then
+    raise exception '寝室不存在';
+  end if;
+  if tg_op = 'INSERT' then
+    select count(*) into current_count from students where room_id = new.room_id;
+  elsif tg_op = 'UPDATE' then
+    if new.room_id = old.room_id then
+      return new;
+    end if;
+    select count(*) into current_count from students where room_id = new.room_id;
+  else
+    return new;
+  end if;
+  if current_count >= room_capacity then
+    raise exception '寝室人数已满';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_check_room_capacity_insert on students;
+create trigger trg_check_room_capacity_insert
+before insert on students
+for each row execute function check_room_capacity();
+drop trigger if exists trg_check_room_capacity_update on students;
+create trigger trg_check_room_capacity_update
+before update on students
+for each row execute function check_room_capacity();
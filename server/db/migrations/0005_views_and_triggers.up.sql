@@ -0,0 +1,121 @@
+create or replace view v_building_occupancy as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(r.capacity), 0) as total_capacity,
+  count(s.id) as occupied_beds,
+  case
+    when coalesce(sum(r.capacity), 0) = 0 then 0
+    else round(count(s.id) * 100.0 / sum(r.capacity), 2)
+  end as occupancy_rate
+from apartment_buildings b
+left join dorm_rooms r on r.building_id = b.id and r.deleted_at is null
+left join students s on s.room_id = r.id and s.deleted_at is null
+where b.deleted_at is null
+group by b.id, b.building_no;
+create or replace view v_building_payment_summary as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as total_amount,
+  coalesce(sum(p.amount) filter (where p.status = 'voided'), 0) as voided_amount,
+  coalesce(-sum(p.amount) filter (where p.reversal_of_id is not null and p.status <> 'voided'), 0) as reversed_amount
+from apartment_buildings b
+left join payments p on p.building_id = b.id and p.deleted_at is null
+where b.deleted_at is null
+group by b.id, b.building_no;
+create or replace function check_room_capacity()
+returns trigger as $$
+declare
+  room_capacity int;
+  current_count int;
+begin
+  if new.room_id is null then
+    return new;
+  end if;
+  if new.deleted_at is not null then
+    return new;
+  end if;
+  select capacity into room_capacity from dorm_rooms where id = new.room_id and deleted_at is null;
+  if room_capacity is null then
+    raise exception '寝室不存在';
+  end if;
+  if tg_op = 'INSERT' then
+    select count(*) into current_count from students where room_id = new.room_id and deleted_at is null;
+  elsif tg_op = 'UPDATE' then
+    -- restoring a soft-deleted student takes a bed again
+    if new.room_id = old.room_id and old.deleted_at is null then
+      return new;
+    end if;
+    select count(*) into current_count from students
+    where room_id = new.room_id and deleted_at is null and id <> new.id;
+  else
+    return new;
+  end if;
+  if current_count >= room_capacity then
+    raise exception '寝室人数已满';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_check_room_capacity_insert on students;
+create trigger trg_check_room_capacity_insert
+before insert on students
+for each row execute function check_room_capacity();
+drop trigger if exists trg_check_room_capacity_update on students;
+create trigger trg_check_room_capacity_update
+before update on students
+for each row execute function check_room_capacity();
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id then
+    raise exception '已入账的交费记录不能修改';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_protect_posted_payment on payments;
+create trigger trg_protect_posted_payment
+before update or delete on payments
+for each row execute function protect_posted_payment();
+-- students and payments always take their building from their room
+create or replace function derive_building_from_room()
+returns trigger as $$
+begin
+  if new.room_id is not null then
+    select building_id into new.building_id from dorm_rooms where id = new.room_id;
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_students_building on students;
+create trigger trg_students_building
+before insert or update of room_id, building_id on students
+for each row execute function derive_building_from_room();
+drop trigger if exists trg_payments_building on payments;
+create trigger trg_payments_building
+before insert or update of room_id, building_id on payments
+for each row execute function derive_building_from_room();
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_move_room_occupants on dorm_rooms;
+create trigger trg_move_room_occupants
+after update of building_id on dorm_rooms
+for each row when (old.building_id is distinct from new.building_id)
+execute function move_room_occupants();
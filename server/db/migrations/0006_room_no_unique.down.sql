@@ -0,0 +1 @@
+drop index if exists idx_rooms_building_room_no;
@@ -0,0 +1,22 @@
+-- Room numbers are unique within a building. Existing duplicates are listed
+-- in the error so they can be fixed before the index is created.
+do $$
+declare
+  dups text;
+begin
+  select string_agg(format('building %s room %s (ids %s)', building_id, room_no, ids), '; ')
+  into dups
+  from (
+    select building_id, room_no, string_agg(id::text, ',' order by id) as ids
+    from dorm_rooms
+    where deleted_at is null
+    group by building_id, room_no
+    having count(*) > 1
+  ) d;
+  if dups is not null then
+    raise exception 'duplicate room numbers: %', dups;
+  end if;
+end
+$$;
+create unique index if not exists idx_rooms_building_room_no
+  on dorm_rooms (building_id, room_no) where deleted_at is null;
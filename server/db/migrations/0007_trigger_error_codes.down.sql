@@ -0,0 +1,52 @@
+create or replace function check_room_capacity()
+returns trigger as $$
+declare
+  room_capacity int;
+  current_count int;
+begin
+  if new.room_id is null then
+    return new;
+  end if;
+  if new.deleted_at is not null then
+    return new;
+  end if;
+  select capacity into room_capacity from dorm_rooms where id = new.room_id and deleted_at is null;
+  if room_capacity is null then
+    raise exception '寝室不存在';
+  end if;
+  if tg_op = 'INSERT' then
+    select count(*) into current_count from students where room_id = new.room_id and deleted_at is null;
+  elsif tg_op = 'UPDATE' then
+    -- restoring a soft-deleted student takes a bed again
+    if new.room_id = old.room_id and old.deleted_at is null then
+      return new;
+    end if;
+    select count(*) into current_count from students
+    where room_id = new.room_id and deleted_at is null and id <> new.id;
+  else
+    return new;
+  end if;
+  if current_count >= room_capacity then
+    raise exception '寝室人数已满';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id then
+    raise exception '已入账的交费记录不能修改';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
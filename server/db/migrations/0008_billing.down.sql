@@ -0,0 +1,34 @@
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除' using constraint = 'payment_no_delete';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id then
+    raise exception '已入账的交费记录不能修改' using constraint = 'payment_immutable';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正' using constraint = 'payment_corrected';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
+
+drop trigger if exists trg_bills_building on bills;
+drop view if exists v_bills;
+alter table payments drop column if exists bill_id;
+drop table if exists bills;
+drop table if exists fee_schedules;
+alter table dorm_rooms drop column if exists room_type;
@@ -0,0 +1,103 @@
+alter table dorm_rooms add column if not exists room_type varchar(20);
+
+create table fee_schedules (
+  id bigserial primary key,
+  term varchar(20) not null,
+  fee_type varchar(50) not null,
+  building_id bigint,
+  room_id bigint,
+  room_type varchar(20),
+  amount decimal not null,
+  version bigint not null default 1,
+  created_at timestamptz,
+  constraint fk_fee_schedules_building foreign key (building_id) references apartment_buildings(id)
+    on delete cascade on update cascade,
+  constraint fk_fee_schedules_room foreign key (room_id) references dorm_rooms(id)
+    on delete cascade on update cascade,
+  constraint chk_fee_schedule_type check (fee_type in ('住宿费','水电费','押金')),
+  constraint chk_fee_schedule_amount check (amount >= 0),
+  -- a room schedule names only the room; the others need a building or a
+  -- room type
+  constraint chk_fee_schedule_target check (
+    case when room_id is not null then building_id is null and coalesce(room_type, '') = ''
+    else building_id is not null or coalesce(room_type, '') <> '' end
+  )
+);
+create index idx_fee_schedules_building_id on fee_schedules (building_id);
+create index idx_fee_schedules_room_id on fee_schedules (room_id);
+create unique index idx_fee_schedules_target on fee_schedules
+  (term, fee_type, coalesce(building_id, 0), coalesce(room_id, 0), coalesce(room_type, ''));
+
+create table bills (
+  id bigserial primary key,
+  term varchar(20) not null,
+  fee_type varchar(50) not null,
+  student_id bigint not null,
+  building_id bigint not null,
+  room_id bigint not null,
+  fee_schedule_id bigint,
+  amount decimal not null,
+  created_at timestamptz,
+  constraint fk_bills_student foreign key (student_id) references students(id),
+  constraint fk_bills_room foreign key (room_id) references dorm_rooms(id),
+  constraint fk_bills_building foreign key (building_id) references apartment_buildings(id)
+    on delete restrict on update cascade,
+  constraint fk_bills_fee_schedule foreign key (fee_schedule_id) references fee_schedules(id)
+    on delete set null,
+  constraint chk_bill_type check (fee_type in ('住宿费','水电费','押金')),
+  constraint chk_bill_amount check (amount >= 0)
+);
+create index idx_bills_student_id on bills (student_id);
+create index idx_bills_room_id on bills (room_id);
+create index idx_bills_building_id on bills (building_id);
+-- a billing run charges each occupant of a room once per fee item and term
+create unique index idx_bills_occupant on bills (term, fee_type, student_id, room_id);
+
+alter table payments add column if not exists bill_id bigint;
+alter table payments add constraint fk_payments_bill foreign key (bill_id) references bills(id);
+create index if not exists idx_payments_bill_id on payments (bill_id);
+
+-- Voided payments do not count. A reversal carries the bill of the payment
+-- it cancels, so the two net to zero.
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+create trigger trg_bills_building
+before insert or update of room_id, building_id on bills
+for each row execute function derive_building_from_room();
+
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  update bills set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
+
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除' using constraint = 'payment_no_delete';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id
+    or new.bill_id is distinct from old.bill_id then
+    raise exception '已入账的交费记录不能修改' using constraint = 'payment_immutable';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正' using constraint = 'payment_corrected';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
@@ -0,0 +1 @@
+drop view if exists v_fee_ledger;
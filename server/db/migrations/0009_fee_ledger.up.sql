@@ -0,0 +1,12 @@
+-- One row per charge and per counted payment. Payments take the term of the
+-- bill they settle; payments without a bill have an empty term.
+create view v_fee_ledger as
+select b.student_id, b.building_id, b.room_id, b.term, b.fee_type,
+  b.amount as charged, 0::decimal as paid
+from bills b
+union all
+select p.student_id, p.building_id, p.room_id, coalesce(b.term, ''), p.payment_type,
+  0::decimal, p.amount
+from payments p
+left join bills b on b.id = p.bill_id
+where p.status <> 'voided' and p.deleted_at is null;
@@ -0,0 +1,63 @@
+drop view if exists v_building_term_payment_summary;
+drop view if exists v_building_term_occupancy;
+drop view if exists v_fee_ledger;
+drop view if exists v_bills;
+
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除' using constraint = 'payment_no_delete';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id
+    or new.bill_id is distinct from old.bill_id then
+    raise exception '已入账的交费记录不能修改' using constraint = 'payment_immutable';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正' using constraint = 'payment_corrected';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+
+alter table payments drop column if exists term_id;
+
+alter table bills add column term varchar(20);
+update bills b set term = t.name from terms t where t.id = b.term_id;
+alter table bills alter column term set not null;
+drop index if exists idx_bills_occupant;
+alter table bills drop column term_id;
+create unique index idx_bills_occupant on bills (term, fee_type, student_id, room_id);
+
+alter table fee_schedules add column term varchar(20);
+update fee_schedules f set term = t.name from terms t where t.id = f.term_id;
+alter table fee_schedules alter column term set not null;
+drop index if exists idx_fee_schedules_target;
+alter table fee_schedules drop column term_id;
+create unique index idx_fee_schedules_target on fee_schedules
+  (term, fee_type, coalesce(building_id, 0), coalesce(room_id, 0), coalesce(room_type, ''));
+
+drop table if exists terms;
+
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+create view v_fee_ledger as
+select b.student_id, b.building_id, b.room_id, b.term, b.fee_type,
+  b.amount as charged, 0::decimal as paid
+from bills b
+union all
+select p.student_id, p.building_id, p.room_id, coalesce(b.term, ''), p.payment_type,
+  0::decimal, p.amount
+from payments p
+left join bills b on b.id = p.bill_id
+where p.status <> 'voided' and p.deleted_at is null;
@@ -0,0 +1,131 @@
+create table terms (
+  id bigserial primary key,
+  name varchar(20) not null,
+  start_date date not null,
+  end_date date not null,
+  status varchar(20) not null default 'open',
+  closed_at timestamptz,
+  version bigint not null default 1,
+  created_at timestamptz,
+  constraint chk_term_dates check (end_date >= start_date),
+  constraint chk_term_status check (status in ('open','closed'))
+);
+create unique index idx_terms_name on terms (name);
+
+-- Terms so far were free text on schedules and bills. Each name becomes a
+-- term spanning the days its rows were created; admins correct the dates.
+insert into terms (name, start_date, end_date, created_at)
+select term, min(created_at)::date, max(created_at)::date, now()
+from (
+  select term, coalesce(created_at, now()) as created_at from fee_schedules
+  union all
+  select term, coalesce(created_at, now()) from bills
+) t
+group by term;
+
+drop view v_fee_ledger;
+drop view v_bills;
+
+alter table fee_schedules add column term_id bigint;
+update fee_schedules f set term_id = t.id from terms t where t.name = f.term;
+alter table fee_schedules alter column term_id set not null;
+alter table fee_schedules add constraint fk_fee_schedules_term foreign key (term_id) references terms(id);
+drop index idx_fee_schedules_target;
+alter table fee_schedules drop column term;
+create unique index idx_fee_schedules_target on fee_schedules
+  (term_id, fee_type, coalesce(building_id, 0), coalesce(room_id, 0), coalesce(room_type, ''));
+
+alter table bills add column term_id bigint;
+update bills b set term_id = t.id from terms t where t.name = b.term;
+alter table bills alter column term_id set not null;
+alter table bills add constraint fk_bills_term foreign key (term_id) references terms(id);
+drop index idx_bills_occupant;
+alter table bills drop column term;
+create index idx_bills_term_id on bills (term_id);
+create unique index idx_bills_occupant on bills (term_id, fee_type, student_id, room_id);
+
+-- Payments take the term of their bill, or else the term they were paid in.
+alter table payments add column term_id bigint;
+alter table payments add constraint fk_payments_term foreign key (term_id) references terms(id);
+create index idx_payments_term_id on payments (term_id);
+update payments p set term_id = b.term_id from bills b where b.id = p.bill_id;
+update payments p set term_id = t.id from terms t
+where p.term_id is null and p.paid_at between t.start_date and t.end_date;
+
+create or replace function protect_posted_payment()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '交费记录不能删除' using constraint = 'payment_no_delete';
+  end if;
+  if new.payment_no <> old.payment_no or new.paid_at <> old.paid_at
+    or new.payment_type <> old.payment_type or new.amount <> old.amount
+    or new.student_id is distinct from old.student_id
+    or new.reversal_of_id is distinct from old.reversal_of_id
+    or new.bill_id is distinct from old.bill_id
+    or new.term_id is distinct from old.term_id then
+    raise exception '已入账的交费记录不能修改' using constraint = 'payment_immutable';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '交费记录已作废或已冲正' using constraint = 'payment_corrected';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+-- Payments without a term are listed with a null term_id.
+create view v_fee_ledger as
+select b.student_id, b.building_id, b.room_id, b.term_id, b.fee_type,
+  b.amount as charged, 0::decimal as paid
+from bills b
+union all
+select p.student_id, p.building_id, p.room_id, p.term_id, p.payment_type,
+  0::decimal, p.amount
+from payments p
+where p.status <> 'voided' and p.deleted_at is null;
+
+-- Per term figures for every building. A building's occupants in a term are
+-- the students charged accommodation for one of its rooms in that term.
+create view v_building_term_occupancy as
+select o.*,
+  case
+    when o.total_capacity = 0 then 0
+    else round(o.occupied_beds * 100.0 / o.total_capacity, 2)
+  end as occupancy_rate
+from (
+  select
+    b.id as building_id,
+    b.building_no,
+    t.id as term_id,
+    coalesce((select sum(r.capacity) from dorm_rooms r
+      where r.building_id = b.id and r.deleted_at is null), 0) as total_capacity,
+    count(distinct bl.student_id) as occupied_beds
+  from apartment_buildings b
+  cross join terms t
+  left join bills bl on bl.building_id = b.id and bl.term_id = t.id and bl.fee_type = '住宿费'
+  where b.deleted_at is null
+  group by b.id, b.building_no, t.id
+) o;
+
+create view v_building_term_payment_summary as
+select
+  b.id as building_id,
+  b.building_no,
+  t.id as term_id,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as total_amount,
+  coalesce(sum(p.amount) filter (where p.status = 'voided'), 0) as voided_amount,
+  coalesce(-sum(p.amount) filter (where p.reversal_of_id is not null and p.status <> 'voided'), 0) as reversed_amount
+from apartment_buildings b
+cross join terms t
+left join payments p on p.building_id = b.id and p.term_id = t.id and p.deleted_at is null
+where b.deleted_at is null
+group by b.id, b.building_no, t.id;
@@ -0,0 +1,35 @@
+drop view if exists v_bills;
+alter table bills drop column if exists full_amount;
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+create or replace view v_building_term_occupancy as
+select o.*,
+  case
+    when o.total_capacity = 0 then 0
+    else round(o.occupied_beds * 100.0 / o.total_capacity, 2)
+  end as occupancy_rate
+from (
+  select
+    b.id as building_id,
+    b.building_no,
+    t.id as term_id,
+    coalesce((select sum(r.capacity) from dorm_rooms r
+      where r.building_id = b.id and r.deleted_at is null), 0) as total_capacity,
+    count(distinct bl.student_id) as occupied_beds
+  from apartment_buildings b
+  cross join terms t
+  left join bills bl on bl.building_id = b.id and bl.term_id = t.id and bl.fee_type = '住宿费'
+  where b.deleted_at is null
+  group by b.id, b.building_no, t.id
+) o;
+
+drop trigger if exists trg_students_stay on students;
+drop function if exists record_student_stay();
+drop table if exists student_stays;
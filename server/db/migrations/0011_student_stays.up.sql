@@ -0,0 +1,97 @@
+-- A stay runs from start_date up to but not including end_date; the
+-- current stay has no end_date.
+create table student_stays (
+  id bigserial primary key,
+  student_id bigint not null,
+  room_id bigint not null,
+  start_date date not null,
+  end_date date,
+  constraint fk_student_stays_student foreign key (student_id) references students(id)
+    on delete cascade,
+  constraint fk_student_stays_room foreign key (room_id) references dorm_rooms(id)
+    on delete cascade,
+  constraint chk_stay_dates check (end_date is null or end_date >= start_date)
+);
+create index idx_student_stays_student_id on student_stays (student_id);
+create index idx_student_stays_room_id on student_stays (room_id);
+create unique index idx_student_stays_open on student_stays (student_id) where end_date is null;
+
+-- Nobody knows when current occupants moved in; assume they have lived in
+-- their rooms since before the first term.
+insert into student_stays (student_id, room_id, start_date)
+select s.id, s.room_id, coalesce((select min(start_date) from terms), current_date)
+from students s
+where s.deleted_at is null and s.room_id <> 0;
+
+-- Moves take effect today unless the transaction sets dorm.move_date.
+create or replace function record_student_stay()
+returns trigger as $$
+declare
+  day date := coalesce(nullif(current_setting('dorm.move_date', true), '')::date, current_date);
+  was_in bigint;
+  now_in bigint;
+begin
+  if tg_op <> 'INSERT' and old.deleted_at is null then
+    was_in := nullif(old.room_id, 0);
+  end if;
+  if tg_op <> 'DELETE' and new.deleted_at is null then
+    now_in := nullif(new.room_id, 0);
+  end if;
+  if was_in is not distinct from now_in then
+    return null;
+  end if;
+  if was_in is not null then
+    update student_stays set end_date = greatest(start_date, day)
+    where student_id = old.id and end_date is null;
+  end if;
+  if now_in is not null then
+    insert into student_stays (student_id, room_id, start_date) values (new.id, now_in, day);
+  end if;
+  return null;
+end;
+$$ language plpgsql;
+
+create trigger trg_students_stay
+after insert or update of room_id, deleted_at or delete on students
+for each row execute function record_student_stay();
+
+-- full_amount is the whole-term price an accommodation bill was prorated
+-- from, so later runs can re-prorate without repricing.
+alter table bills add column full_amount decimal;
+update bills set full_amount = amount;
+alter table bills alter column full_amount set not null;
+
+drop view v_bills;
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+-- A building's occupants in a term are now the students who stayed in one of
+-- its rooms during the term.
+create or replace view v_building_term_occupancy as
+select o.*,
+  case
+    when o.total_capacity = 0 then 0
+    else round(o.occupied_beds * 100.0 / o.total_capacity, 2)
+  end as occupancy_rate
+from (
+  select
+    b.id as building_id,
+    b.building_no,
+    t.id as term_id,
+    coalesce((select sum(r.capacity) from dorm_rooms r
+      where r.building_id = b.id and r.deleted_at is null), 0) as total_capacity,
+    count(distinct st.student_id) as occupied_beds
+  from apartment_buildings b
+  cross join terms t
+  left join dorm_rooms r on r.building_id = b.id
+  left join student_stays st on st.room_id = r.id and st.start_date <= t.end_date
+    and (st.end_date is null or st.end_date > t.start_date)
+  where b.deleted_at is null
+  group by b.id, b.building_no, t.id
+) o;
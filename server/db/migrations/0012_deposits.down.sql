@@ -0,0 +1,15 @@
+drop view if exists v_building_deposits;
+drop view if exists v_deposit_ledger;
+
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  update bills set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
+
+drop table if exists deposit_transactions;
+drop function if exists protect_deposit_transaction();
@@ -0,0 +1,99 @@
+-- Money taken out of a student's deposit. Deposits themselves are received
+-- as payments of type 押金.
+create table deposit_transactions (
+  id bigserial primary key,
+  student_id bigint not null,
+  building_id bigint not null,
+  room_id bigint not null,
+  kind varchar(20) not null,
+  description varchar(100),
+  amount decimal not null,
+  occurred_at date not null,
+  status varchar(20) not null default 'posted',
+  reason varchar(200),
+  voided_at timestamptz,
+  created_at timestamptz,
+  constraint fk_deposit_transactions_student foreign key (student_id) references students(id),
+  constraint fk_deposit_transactions_room foreign key (room_id) references dorm_rooms(id),
+  constraint fk_deposit_transactions_building foreign key (building_id) references apartment_buildings(id)
+    on delete restrict on update cascade,
+  constraint chk_deposit_kind check (kind in ('refund','deduction')),
+  constraint chk_deposit_amount check (amount > 0),
+  constraint chk_deposit_description check (kind <> 'deduction' or coalesce(description, '') <> ''),
+  constraint chk_deposit_status check (status in ('posted','voided'))
+);
+create index idx_deposit_transactions_student_id on deposit_transactions (student_id);
+create index idx_deposit_transactions_room_id on deposit_transactions (room_id);
+create index idx_deposit_transactions_building_id on deposit_transactions (building_id);
+
+create trigger trg_deposit_transactions_building
+before insert or update of room_id, building_id on deposit_transactions
+for each row execute function derive_building_from_room();
+
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  update bills set building_id = new.building_id where room_id = new.id;
+  update deposit_transactions set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
+
+-- Like payments, deposit transactions are never deleted or edited; a
+-- mistake is voided.
+create or replace function protect_deposit_transaction()
+returns trigger as $$
+begin
+  if tg_op = 'DELETE' then
+    raise exception '押金记录不能删除' using constraint = 'deposit_immutable';
+  end if;
+  if new.student_id <> old.student_id or new.kind <> old.kind
+    or new.description is distinct from old.description
+    or new.amount <> old.amount or new.occurred_at <> old.occurred_at then
+    raise exception '押金记录不能修改' using constraint = 'deposit_immutable';
+  end if;
+  if new.status <> old.status and old.status <> 'posted' then
+    raise exception '押金记录已作废' using constraint = 'deposit_voided';
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+
+create trigger trg_protect_deposit_transaction
+before update or delete on deposit_transactions
+for each row execute function protect_deposit_transaction();
+
+-- One signed row per deposit movement: receipts and their reversals are
+-- positive and negative payments, refunds and deductions are negative.
+create view v_deposit_ledger as
+select p.student_id, p.building_id, p.room_id, p.paid_at as entry_date,
+  case when p.reversal_of_id is null then 'received' else 'reversal' end as kind,
+  ''::varchar as description, p.amount, p.id as payment_id, null::bigint as transaction_id
+from payments p
+where p.payment_type = '押金' and p.status <> 'voided' and p.deleted_at is null
+union all
+select d.student_id, d.building_id, d.room_id, d.occurred_at, d.kind,
+  coalesce(d.description, ''), -d.amount, null, d.id
+from deposit_transactions d
+where d.status <> 'voided';
+
+-- Deposits are counted in the building the student lives in, or last lived
+-- in; receipts without a student stay with the building they were paid in.
+create view v_building_deposits as
+select
+  b.id as building_id,
+  b.building_no,
+  coalesce(sum(l.amount) filter (where l.kind in ('received','reversal')), 0) as received_amount,
+  coalesce(-sum(l.amount) filter (where l.kind = 'refund'), 0) as refunded_amount,
+  coalesce(-sum(l.amount) filter (where l.kind = 'deduction'), 0) as deducted_amount,
+  coalesce(sum(l.amount), 0) as held_amount
+from apartment_buildings b
+left join (
+  select coalesce(s.building_id, l.building_id) as building_id, l.kind, l.amount
+  from v_deposit_ledger l
+  left join students s on s.id = l.student_id
+) l on l.building_id = b.id
+where b.deleted_at is null
+group by b.id, b.building_no;
@@ -0,0 +1,21 @@
+create or replace view v_fee_ledger as
+select b.student_id, b.building_id, b.room_id, b.term_id, b.fee_type,
+  b.amount as charged, 0::decimal as paid
+from bills b
+union all
+select p.student_id, p.building_id, p.room_id, p.term_id, p.payment_type,
+  0::decimal, p.amount
+from payments p
+where p.status <> 'voided' and p.deleted_at is null;
+
+drop view if exists v_bills;
+create view v_bills as
+select
+  b.*,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) as paid_amount,
+  coalesce(sum(p.amount) filter (where p.status <> 'voided'), 0) >= b.amount as settled
+from bills b
+left join payments p on p.bill_id = b.id and p.deleted_at is null
+group by b.id;
+
+drop table if exists bill_adjustments;
@@ -0,0 +1,49 @@
+-- Bills stay as issued. A later change to what is owed, such as a transfer
+-- re-prorating accommodation, is a signed adjustment: negative credits the
+-- bill, positive charges more.
+create table bill_adjustments (
+  id bigserial primary key,
+  bill_id bigint not null,
+  amount decimal not null,
+  reason varchar(50) not null,
+  created_at timestamptz,
+  constraint fk_bill_adjustments_bill foreign key (bill_id) references bills(id),
+  constraint chk_bill_adjustment_amount check (amount <> 0)
+);
+create index idx_bill_adjustments_bill_id on bill_adjustments (bill_id);
+
+-- due_amount is what the bill comes to after adjustments; overpaid_amount
+-- is what was paid beyond it and is owed back to the student.
+drop view v_bills;
+create view v_bills as
+select
+  b.*,
+  b.amount + coalesce(a.total, 0) as due_amount,
+  coalesce(p.paid, 0) as paid_amount,
+  coalesce(p.paid, 0) >= b.amount + coalesce(a.total, 0) as settled,
+  greatest(coalesce(p.paid, 0) - b.amount - coalesce(a.total, 0), 0) as overpaid_amount
+from bills b
+left join (
+  select bill_id, sum(amount) as total from bill_adjustments group by bill_id
+) a on a.bill_id = b.id
+left join (
+  select bill_id, sum(amount) filter (where status <> 'voided') as paid
+  from payments
+  where bill_id is not null and deleted_at is null
+  group by bill_id
+) p on p.bill_id = b.id;
+
+create or replace view v_fee_ledger as
+select b.student_id, b.building_id, b.room_id, b.term_id, b.fee_type,
+  b.amount as charged, 0::decimal as paid
+from bills b
+union all
+select b.student_id, b.building_id, b.room_id, b.term_id, b.fee_type,
+  a.amount, 0::decimal
+from bill_adjustments a
+join bills b on b.id = a.bill_id
+union all
+select p.student_id, p.building_id, p.room_id, p.term_id, p.payment_type,
+  0::decimal, p.amount
+from payments p
+where p.status <> 'voided' and p.deleted_at is null;
@@ -0,0 +1,21 @@
+drop trigger if exists trg_payments_building on payments;
+create trigger trg_payments_building
+before insert or update of room_id, building_id on payments
+for each row execute function derive_building_from_room();
+drop function if exists derive_payment_building();
+
+drop trigger if exists trg_students_building on students;
+create trigger trg_students_building
+before insert or update of room_id, building_id on students
+for each row execute function derive_building_from_room();
+
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id where room_id = new.id;
+  update payments set building_id = new.building_id where room_id = new.id;
+  update bills set building_id = new.building_id where room_id = new.id;
+  update deposit_transactions set building_id = new.building_id where room_id = new.id;
+  return new;
+end;
+$$ language plpgsql;
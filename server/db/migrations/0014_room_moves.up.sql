@@ -0,0 +1,35 @@
+-- Moving a room to another building moves the students living in it, but
+-- the ledger keeps the building every bill, payment and deposit was posted
+-- to, and checked-out students keep the one they left.
+create or replace function move_room_occupants()
+returns trigger as $$
+begin
+  update students set building_id = new.building_id
+  where room_id = new.id and deleted_at is null;
+  return new;
+end;
+$$ language plpgsql;
+
+-- A restored student takes the building their room is in now.
+drop trigger if exists trg_students_building on students;
+create trigger trg_students_building
+before insert or update of room_id, building_id, deleted_at on students
+for each row execute function derive_building_from_room();
+
+-- A payment against a bill is posted to the bill's room and building, even
+-- if the room has moved since.
+create or replace function derive_payment_building()
+returns trigger as $$
+begin
+  if new.bill_id is not null then
+    select room_id, building_id into new.room_id, new.building_id from bills where id = new.bill_id;
+  elsif new.room_id is not null then
+    select building_id into new.building_id from dorm_rooms where id = new.room_id;
+  end if;
+  return new;
+end;
+$$ language plpgsql;
+drop trigger if exists trg_payments_building on payments;
+create trigger trg_payments_building
+before insert or update of room_id, building_id on payments
+for each row execute function derive_payment_building();
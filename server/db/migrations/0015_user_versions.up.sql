@@ -0,0 +1,2 @@
+-- Accounts are edited under If-Match like the other versioned rows.
+alter table users add column if not exists version bigint not null default 1;
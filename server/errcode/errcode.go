@@ -0,0 +1,387 @@
+// Package errcode is the catalogue of API error codes. Clients switch on the
+// code; the message is for people and follows Accept-Language.
+package errcode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Code is a stable machine-readable error identifier. Codes are never
+// renamed or reused once released.
+type Code string
+
+const (
+	LangZH = "zh"
+	LangEN = "en"
+)
+
+// Request and lookup errors.
+const (
+	InvalidRequest   Code = "INVALID_REQUEST"
+	MalformedJSON    Code = "MALFORMED_JSON"
+	InvalidType      Code = "INVALID_TYPE"
+	ExpectedNumber   Code = "EXPECTED_NUMBER"
+	ExpectedString   Code = "EXPECTED_STRING"
+	ExpectedBoolean  Code = "EXPECTED_BOOLEAN"
+	InvalidID        Code = "INVALID_ID"
+	InvalidDate      Code = "INVALID_DATE"
+	Required         Code = "REQUIRED"
+	NotFound         Code = "NOT_FOUND"
+	EndpointNotFound Code = "ENDPOINT_NOT_FOUND"
+	QueryFailed      Code = "QUERY_FAILED"
+	CreateFailed     Code = "CREATE_FAILED"
+	UpdateFailed     Code = "UPDATE_FAILED"
+	DeleteFailed     Code = "DELETE_FAILED"
+	RestoreFailed    Code = "RESTORE_FAILED"
+	ImportFailed     Code = "IMPORT_FAILED"
+	ImportSize       Code = "IMPORT_SIZE"
+	ImportDuplicate  Code = "IMPORT_DUPLICATE"
+	IfMatchRequired  Code = "IF_MATCH_REQUIRED"
+	VersionConflict  Code = "VERSION_CONFLICT"
+	NotInTrash       Code = "NOT_IN_TRASH"
+	DeletedAdminOnly Code = "DELETED_ADMIN_ONLY"
+)
+
+// Authentication and authorization errors.
+const (
+	Unauthenticated          Code = "UNAUTHENTICATED"
+	TokenMissing             Code = "TOKEN_MISSING"
+	MalformedToken           Code = "MALFORMED_TOKEN"
+	InvalidToken             Code = "INVALID_TOKEN"
+	TokenRevoked             Code = "TOKEN_REVOKED"
+	InvalidAPIKey            Code = "INVALID_API_KEY"
+	APIKeyRevoked            Code = "API_KEY_REVOKED"
+	Forbidden                Code = "FORBIDDEN"
+	BuildingForbidden        Code = "BUILDING_FORBIDDEN"
+	APIKeyForbidden          Code = "API_KEY_FORBIDDEN"
+	LoginFailed              Code = "LOGIN_FAILED"
+	InvalidCredentials       Code = "INVALID_CREDENTIALS"
+	AccountLocked            Code = "ACCOUNT_LOCKED"
+	TooManyLoginAttempts     Code = "TOO_MANY_LOGIN_ATTEMPTS"
+	LogoutFailed             Code = "LOGOUT_FAILED"
+	InvalidRefreshToken      Code = "INVALID_REFRESH_TOKEN"
+	RefreshTokenRevoked      Code = "REFRESH_TOKEN_REVOKED"
+	RefreshFailed            Code = "REFRESH_FAILED"
+	PasswordChangeRequired   Code = "PASSWORD_CHANGE_REQUIRED"
+	TOTPEnrollmentRequired   Code = "TOTP_ENROLLMENT_REQUIRED"
+	TOTPRequiredForRole      Code = "TOTP_REQUIRED_FOR_ROLE"
+	TOTPNotEnabled           Code = "TOTP_NOT_ENABLED"
+	TOTPAlreadyEnabled       Code = "TOTP_ALREADY_ENABLED"
+	TOTPSetupRequired        Code = "TOTP_SETUP_REQUIRED"
+	InvalidTOTPCode          Code = "INVALID_TOTP_CODE"
+	ChallengeExpired         Code = "CHALLENGE_EXPIRED"
+	KeyGenerationFailed      Code = "KEY_GENERATION_FAILED"
+	APIKeyServiceAccountOnly Code = "API_KEY_SERVICE_ACCOUNT_ONLY"
+	NameRequired             Code = "NAME_REQUIRED"
+	ScopesRequired           Code = "SCOPES_REQUIRED"
+	UnknownScope             Code = "UNKNOWN_SCOPE"
+	ScopeExceedsRole         Code = "SCOPE_EXCEEDS_ROLE"
+	ExpiryInPast             Code = "EXPIRY_IN_PAST"
+)
+
+// User and password errors.
+const (
+	UserNotFound             Code = "USER_NOT_FOUND"
+	UnknownRole              Code = "UNKNOWN_ROLE"
+	DuplicateUsername        Code = "DUPLICATE_USERNAME"
+	BuildingsManagerOnly     Code = "BUILDINGS_MANAGER_ONLY"
+	ServiceAccountPassword   Code = "SERVICE_ACCOUNT_PASSWORD"
+	LastAdmin                Code = "LAST_ADMIN"
+	PasswordRequired         Code = "PASSWORD_REQUIRED"
+	PasswordHashFailed       Code = "PASSWORD_HASH_FAILED"
+	WrongPassword            Code = "WRONG_PASSWORD"
+	WrongOldPassword         Code = "WRONG_OLD_PASSWORD"
+	PasswordUnchanged        Code = "PASSWORD_UNCHANGED"
+	PasswordTooShort         Code = "PASSWORD_TOO_SHORT"
+	PasswordTooSimple        Code = "PASSWORD_TOO_SIMPLE"
+	PasswordContainsUsername Code = "PASSWORD_CONTAINS_USERNAME"
+)
+
+// Dormitory errors.
+const (
+	BuildingNotFound            Code = "BUILDING_NOT_FOUND"
+	BuildingRequired            Code = "BUILDING_REQUIRED"
+	BuildingAndRoomRequired     Code = "BUILDING_AND_ROOM_REQUIRED"
+	BuildingDeleted             Code = "BUILDING_DELETED"
+	DuplicateBuildingNo         Code = "DUPLICATE_BUILDING_NO"
+	InvalidFloorCount           Code = "INVALID_FLOOR_COUNT"
+	InvalidRoomCount            Code = "INVALID_ROOM_COUNT"
+	RoomNotFound                Code = "ROOM_NOT_FOUND"
+	RoomNotInBuilding           Code = "ROOM_NOT_IN_BUILDING"
+	RoomDeleted                 Code = "ROOM_DELETED"
+	RoomFull                    Code = "ROOM_FULL"
+	DuplicateRoomNo             Code = "DUPLICATE_ROOM_NO"
+	InvalidRoomNo               Code = "INVALID_ROOM_NO"
+	RoomFloorOutOfRange         Code = "ROOM_FLOOR_OUT_OF_RANGE"
+	InvalidRoomCapacity         Code = "INVALID_ROOM_CAPACITY"
+	InvalidRoomFee              Code = "INVALID_ROOM_FEE"
+	StudentNotFound             Code = "STUDENT_NOT_FOUND"
+	StudentNotInRoom            Code = "STUDENT_NOT_IN_ROOM"
+	DuplicateStudentNo          Code = "DUPLICATE_STUDENT_NO"
+	InvalidStudentNo            Code = "INVALID_STUDENT_NO"
+	InvalidGender               Code = "INVALID_GENDER"
+	InvalidPhone                Code = "INVALID_PHONE"
+	HasDependencies             Code = "HAS_DEPENDENCIES"
+	HasPayments                 Code = "HAS_PAYMENTS"
+	HasBills                    Code = "HAS_BILLS"
+	CascadeConfirmationMismatch Code = "CASCADE_CONFIRMATION_MISMATCH"
+)
+
+// Payment errors.
+const (
+	DuplicatePaymentNo      Code = "DUPLICATE_PAYMENT_NO"
+	InvalidPaymentType      Code = "INVALID_PAYMENT_TYPE"
+	AmountNotPositive       Code = "AMOUNT_NOT_POSITIVE"
+	PaymentImmutable        Code = "PAYMENT_IMMUTABLE"
+	PaymentAlreadyCorrected Code = "PAYMENT_ALREADY_CORRECTED"
+	ReversalNotCorrectable  Code = "REVERSAL_NOT_CORRECTABLE"
+	ReasonRequired          Code = "REASON_REQUIRED"
+	VoidFailed              Code = "VOID_FAILED"
+	ReverseFailed           Code = "REVERSE_FAILED"
+)
+
+// Fee schedule and billing errors.
+const (
+	AmountNegative           Code = "AMOUNT_NEGATIVE"
+	InvalidFeeScheduleTarget Code = "INVALID_FEE_SCHEDULE_TARGET"
+	DuplicateFeeSchedule     Code = "DUPLICATE_FEE_SCHEDULE"
+	DuplicateBill            Code = "DUPLICATE_BILL"
+	BillNotFound             Code = "BILL_NOT_FOUND"
+	PaymentBillMismatch      Code = "PAYMENT_BILL_MISMATCH"
+	PaymentExceedsBill       Code = "PAYMENT_EXCEEDS_BILL"
+	BillingFailed            Code = "BILLING_FAILED"
+)
+
+// Term errors.
+const (
+	TermNotFound        Code = "TERM_NOT_FOUND"
+	TermClosed          Code = "TERM_CLOSED"
+	TermAlreadyOpen     Code = "TERM_ALREADY_OPEN"
+	TermAlreadyClosed   Code = "TERM_ALREADY_CLOSED"
+	TermDatesInvalid    Code = "TERM_DATES_INVALID"
+	TermOverlap         Code = "TERM_OVERLAP"
+	DuplicateTermName   Code = "DUPLICATE_TERM_NAME"
+	PaymentTermMismatch Code = "PAYMENT_TERM_MISMATCH"
+)
+
+// Deposit errors.
+const (
+	DepositItemsRequired Code = "DEPOSIT_ITEMS_REQUIRED"
+	NoDepositHeld        Code = "NO_DEPOSIT_HELD"
+	DepositExceedsHeld   Code = "DEPOSIT_EXCEEDS_HELD"
+	DepositImmutable     Code = "DEPOSIT_IMMUTABLE"
+	DepositAlreadyVoided Code = "DEPOSIT_ALREADY_VOIDED"
+	InvalidDepositKind   Code = "INVALID_DEPOSIT_KIND"
+)
+
+// messages holds the zh and en text of every code. Messages may take
+// fmt arguments.
+var messages = map[Code][2]string{
+	InvalidRequest:   {"请求数据不合法", "Invalid request data"},
+	MalformedJSON:    {"JSON格式错误", "Malformed JSON"},
+	InvalidType:      {"类型不正确", "Wrong type"},
+	ExpectedNumber:   {"类型不正确，应为数字", "Wrong type, expected a number"},
+	ExpectedString:   {"类型不正确，应为字符串", "Wrong type, expected a string"},
+	ExpectedBoolean:  {"类型不正确，应为布尔值", "Wrong type, expected a boolean"},
+	InvalidID:        {"无效的ID", "Invalid ID"},
+	InvalidDate:      {"日期格式应为YYYY-MM-DD", "Dates must use the YYYY-MM-DD format"},
+	Required:         {"不能为空", "Required"},
+	NotFound:         {"记录不存在", "Record not found"},
+	EndpointNotFound: {"接口不存在", "Endpoint not found"},
+	QueryFailed:      {"查询失败", "Query failed"},
+	CreateFailed:     {"创建失败", "Create failed"},
+	UpdateFailed:     {"更新失败", "Update failed"},
+	DeleteFailed:     {"删除失败", "Delete failed"},
+	RestoreFailed:    {"恢复失败", "Restore failed"},
+	ImportFailed:     {"导入失败", "Import failed"},
+	ImportSize:       {"每次导入1到%d条记录", "Import between 1 and %d records at a time"},
+	ImportDuplicate:  {"导入数据中学号重复", "The student number repeats within the import"},
+	IfMatchRequired:  {"缺少If-Match请求头", "The If-Match header is required"},
+	VersionConflict:  {"数据已被其他用户修改，请刷新后重试", "The record was changed by someone else, reload and try again"},
+	NotInTrash:       {"回收站中没有该记录", "The record is not in the trash"},
+	DeletedAdminOnly: {"只有管理员可以查看已删除的数据", "Only administrators can see deleted records"},
+
+	Unauthenticated:          {"未登录", "Not logged in"},
+	TokenMissing:             {"缺少令牌", "Missing token"},
+	MalformedToken:           {"令牌格式错误", "Malformed token"},
+	InvalidToken:             {"令牌无效", "Invalid token"},
+	TokenRevoked:             {"令牌已失效", "The token has been revoked"},
+	InvalidAPIKey:            {"API密钥无效", "Invalid API key"},
+	APIKeyRevoked:            {"API密钥已失效", "The API key has been revoked"},
+	Forbidden:                {"没有操作权限", "Permission denied"},
+	BuildingForbidden:        {"无权操作该公寓的数据", "You may not access this building's data"},
+	APIKeyForbidden:          {"API密钥不能访问该接口", "API keys cannot use this endpoint"},
+	LoginFailed:              {"登录失败", "Login failed"},
+	InvalidCredentials:       {"用户名或密码错误", "Wrong username or password"},
+	AccountLocked:            {"账号已被锁定，请稍后再试", "The account is locked, try again later"},
+	TooManyLoginAttempts:     {"登录尝试过于频繁，请稍后再试", "Too many login attempts, try again later"},
+	LogoutFailed:             {"退出登录失败", "Logout failed"},
+	InvalidRefreshToken:      {"刷新令牌无效", "Invalid refresh token"},
+	RefreshTokenRevoked:      {"刷新令牌已失效", "The refresh token has been revoked"},
+	RefreshFailed:            {"刷新令牌失败", "Token refresh failed"},
+	PasswordChangeRequired:   {"请先修改初始密码", "Change your initial password first"},
+	TOTPEnrollmentRequired:   {"请先启用两步验证", "Enable two-factor authentication first"},
+	TOTPRequiredForRole:      {"当前角色必须启用两步验证", "Your role requires two-factor authentication"},
+	TOTPNotEnabled:           {"未启用两步验证", "Two-factor authentication is not enabled"},
+	TOTPAlreadyEnabled:       {"已启用两步验证", "Two-factor authentication is already enabled"},
+	TOTPSetupRequired:        {"请先生成两步验证密钥", "Generate a two-factor secret first"},
+	InvalidTOTPCode:          {"验证码错误", "Wrong verification code"},
+	ChallengeExpired:         {"验证已过期，请重新登录", "The verification expired, log in again"},
+	KeyGenerationFailed:      {"生成密钥失败", "Key generation failed"},
+	APIKeyServiceAccountOnly: {"只有服务账号可以使用API密钥", "Only service accounts can have API keys"},
+	NameRequired:             {"名称不能为空", "Name is required"},
+	ScopesRequired:           {"权限范围不能为空", "At least one scope is required"},
+	UnknownScope:             {"未知的权限范围: %s", "Unknown scope: %s"},
+	ScopeExceedsRole:         {"权限范围超出账号角色: %s", "Scope exceeds the account's role: %s"},
+	ExpiryInPast:             {"过期时间必须晚于当前时间", "The expiry must be in the future"},
+
+	UserNotFound:             {"用户不存在", "User not found"},
+	UnknownRole:              {"未知的用户角色", "Unknown role"},
+	DuplicateUsername:        {"用户名已存在", "The username is taken"},
+	BuildingsManagerOnly:     {"只有楼栋管理员可以分配公寓", "Only building managers can be assigned buildings"},
+	ServiceAccountPassword:   {"服务账号不能设置密码", "Service accounts cannot have a password"},
+	LastAdmin:                {"不能删除或降级最后一个管理员", "The last admin cannot be removed or demoted"},
+	PasswordRequired:         {"密码不能为空", "Password is required"},
+	PasswordHashFailed:       {"密码处理失败", "Password processing failed"},
+	WrongPassword:            {"密码错误", "Wrong password"},
+	WrongOldPassword:         {"原密码错误", "Wrong current password"},
+	PasswordUnchanged:        {"新密码不能与原密码相同", "The new password must differ from the current one"},
+	PasswordTooShort:         {"密码长度不能少于%d位", "Passwords need at least %d characters"},
+	PasswordTooSimple:        {"密码需包含小写字母、大写字母、数字、特殊字符中的至少%d类", "Passwords need at least %d of lower case, upper case, digits and symbols"},
+	PasswordContainsUsername: {"密码不能包含用户名", "Passwords must not contain the username"},
+
+	BuildingNotFound:            {"公寓不存在", "Building not found"},
+	BuildingRequired:            {"所属公寓不能为空", "Building is required"},
+	BuildingAndRoomRequired:     {"公寓号和寝室号不能为空", "Building and room are required"},
+	BuildingDeleted:             {"所属公寓已删除，请先恢复公寓", "The building is deleted, restore it first"},
+	DuplicateBuildingNo:         {"公寓号已存在", "The building number is taken"},
+	InvalidFloorCount:           {"楼层数必须大于0", "Floor count must be positive"},
+	InvalidRoomCount:            {"房间数不能为负数", "Room count cannot be negative"},
+	RoomNotFound:                {"寝室不存在", "Room not found"},
+	RoomNotInBuilding:           {"寝室不属于该公寓", "The room is not in this building"},
+	RoomDeleted:                 {"所在寝室已删除，请先恢复寝室", "The room is deleted, restore it first"},
+	RoomFull:                    {"寝室人数已满", "The room is full"},
+	DuplicateRoomNo:             {"该公寓中已存在相同的寝室号", "The building already has a room with this number"},
+	InvalidRoomNo:               {"寝室号应为楼层加两位序号，如305", "Room numbers are the floor plus two digits, e.g. 305"},
+	RoomFloorOutOfRange:         {"寝室号的楼层超出公寓楼层数%d", "The room's floor exceeds the building's %d floors"},
+	InvalidRoomCapacity:         {"寝室容量必须大于0", "Room capacity must be positive"},
+	InvalidRoomFee:              {"寝室费用不能为负数", "Room fee cannot be negative"},
+	StudentNotFound:             {"学生不存在", "Student not found"},
+	StudentNotInRoom:            {"学生不在指定公寓寝室中", "The student does not live in this room"},
+	DuplicateStudentNo:          {"学号已存在", "The student number is taken"},
+	InvalidStudentNo:            {"学号应为8到12位数字", "Student numbers have 8 to 12 digits"},
+	InvalidGender:               {"性别只能是男或女", "Gender must be 男 or 女"},
+	InvalidPhone:                {"电话号码格式不正确", "Invalid phone number"},
+	HasDependencies:             {"存在关联数据，请确认后级联删除", "Dependent records exist, confirm a cascading delete"},
+	HasPayments:                 {"存在交费记录，无法删除", "Payments exist, the record cannot be deleted"},
+	HasBills:                    {"存在账单，无法删除", "Bills exist, the record cannot be deleted"},
+	CascadeConfirmationMismatch: {"级联删除确认信息不匹配", "The cascade confirmation does not match"},
+
+	DuplicatePaymentNo:      {"交费编号已存在", "The payment number is taken"},
+	InvalidPaymentType:      {"收费类型必须是住宿费、水电费或押金", "Payment type must be 住宿费, 水电费 or 押金"},
+	AmountNotPositive:       {"金额必须大于0", "Amount must be positive"},
+	PaymentImmutable:        {"交费记录已入账，只能作废或冲正", "Posted payments can only be voided or reversed"},
+	PaymentAlreadyCorrected: {"交费记录已作废或已冲正", "The payment is already voided or reversed"},
+	ReversalNotCorrectable:  {"冲正记录不能再更正", "Reversal entries cannot be corrected"},
+	ReasonRequired:          {"请填写更正原因", "A reason is required"},
+	VoidFailed:              {"作废失败", "Void failed"},
+	ReverseFailed:           {"冲正失败", "Reversal failed"},
+
+	AmountNegative:           {"金额不能为负数", "Amount cannot be negative"},
+	InvalidFeeScheduleTarget: {"请指定寝室，或公寓和寝室类型中的至少一项", "Give a room, or a building and/or a room type"},
+	DuplicateFeeSchedule:     {"该学期已存在相同范围的收费标准", "A fee schedule with the same target exists for this term"},
+	DuplicateBill:            {"账单已存在", "The bill already exists"},
+	BillNotFound:             {"账单不存在", "Bill not found"},
+	PaymentBillMismatch:      {"交费的学生、房间或收费类型与账单不一致", "The payment's student, room or type does not match the bill"},
+	PaymentExceedsBill:       {"交费金额超出账单未付金额", "The amount exceeds what is owed on the bill"},
+	BillingFailed:            {"生成账单失败", "Billing run failed"},
+
+	TermNotFound:        {"学期不存在", "Term not found"},
+	TermClosed:          {"学期已关闭", "The term is closed"},
+	TermAlreadyOpen:     {"学期已开启", "The term is already open"},
+	TermAlreadyClosed:   {"学期已关闭", "The term is already closed"},
+	TermDatesInvalid:    {"结束日期不能早于开始日期", "The end date cannot be before the start date"},
+	TermOverlap:         {"学期日期与已有学期重叠", "The dates overlap another term"},
+	DuplicateTermName:   {"学期名称已存在", "A term with this name exists"},
+	PaymentTermMismatch: {"交费学期与账单学期不一致", "The payment's term does not match the bill"},
+
+	DepositItemsRequired: {"请至少填写一项扣款", "Give at least one deduction item"},
+	NoDepositHeld:        {"该学生没有可退还的押金", "The student has no deposit to refund"},
+	DepositExceedsHeld:   {"退还或扣除金额超出押金余额", "The amount exceeds the deposit held"},
+	DepositImmutable:     {"押金记录不能修改或删除，只能作废", "Deposit transactions can only be voided"},
+	DepositAlreadyVoided: {"押金记录已作废", "The deposit transaction is already voided"},
+	InvalidDepositKind:   {"押金记录类型只能是退还或扣除", "The kind must be refund or deduction"},
+}
+
+// Message renders the code in lang, falling back to Chinese.
+func (c Code) Message(lang string, args ...interface{}) string {
+	pair, ok := messages[c]
+	if !ok {
+		return string(c)
+	}
+	msg := pair[0]
+	if lang == LangEN {
+		msg = pair[1]
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Error carries a code and its message arguments through code that has no
+// request to answer.
+type Error struct {
+	Code Code
+	Args []interface{}
+}
+
+func New(code Code, args ...interface{}) *Error {
+	return &Error{Code: code, Args: args}
+}
+
+func (e *Error) Error() string {
+	return e.Code.Message(LangZH, e.Args...)
+}
+
+// Lang picks zh or en from an Accept-Language header. Chinese is the
+// default.
+func Lang(acceptLanguage string) string {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		t := tag{lang: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(f), "q="); ok {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					t.q = q
+				}
+			}
+		}
+		if t.lang != "" && t.q > 0 {
+			tags = append(tags, t)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		switch {
+		case t.lang == LangZH || strings.HasPrefix(t.lang, "zh-"):
+			return LangZH
+		case t.lang == LangEN || strings.HasPrefix(t.lang, "en-"):
+			return LangEN
+		}
+	}
+	return LangZH
+}
+
+// Body is the JSON error body: the code plus the localized message.
+func Body(code Code, lang string, args ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"code": code, "error": code.Message(lang, args...)}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+const apiKeyPrefix = "dk_"
+
+type APIKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expiresAt"`
+}
+
+type APIKeyResponse struct {
+	models.APIKey
+	// Key is only returned when the key is created.
+	Key string `json:"key"`
+}
+
+// authenticateAPIKey resolves a key of the form dk_<prefix>_<secret> to the
+// service account that owns it.
+func authenticateAPIKey(key string) (AuthUser, errcode.Code) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return AuthUser{}, errcode.InvalidAPIKey
+	}
+	var k models.APIKey
+	if err := db.DB.Where("key_hash = ?", hashToken(key)).First(&k).Error; err != nil {
+		return AuthUser{}, errcode.InvalidAPIKey
+	}
+	now := time.Now()
+	if k.RevokedAt != nil || (k.ExpiresAt != nil && now.After(*k.ExpiresAt)) {
+		return AuthUser{}, errcode.APIKeyRevoked
+	}
+	var u models.User
+	if err := db.DB.First(&u, k.UserID).Error; err != nil || !u.ServiceAccount {
+		return AuthUser{}, errcode.InvalidAPIKey
+	}
+	// Only record use once a minute to keep reads from turning into writes.
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > time.Minute {
+		db.DB.Model(&k).Update("last_used_at", now)
+	}
+	return AuthUser{
+		ID:       u.ID,
+		Username: u.Username,
+		Role:     u.Role,
+		APIKeyID: k.ID,
+		Scopes:   strings.Split(k.Scopes, ","),
+	}, ""
+}
+
+func loadServiceAccount(c *gin.Context) (models.User, bool) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return models.User{}, false
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return models.User{}, false
+	}
+	if !u.ServiceAccount {
+		respondError(c, http.StatusBadRequest, errcode.APIKeyServiceAccountOnly)
+		return models.User{}, false
+	}
+	return u, true
+}
+
+func ListAPIKeys(c *gin.Context) {
+	u, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	var list []models.APIKey
+	if err := db.DB.Where("user_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func CreateAPIKey(c *gin.Context) {
+	u, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	var req APIKeyRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Name == "" {
+		respondError(c, http.StatusBadRequest, errcode.NameRequired)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		respondError(c, http.StatusBadRequest, errcode.ScopesRequired)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !IsKnownPermission(scope) {
+			respondError(c, http.StatusBadRequest, errcode.UnknownScope, scope)
+			return
+		}
+		if !HasPermission(u.Role, scope) {
+			respondError(c, http.StatusBadRequest, errcode.ScopeExceedsRole, scope)
+			return
+		}
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != "" {
+		t, err := time.Parse("2006-01-02", req.ExpiresAt)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, req.ExpiresAt)
+		}
+		if err != nil {
+			respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "expiresAt"})
+			return
+		}
+		if !t.After(time.Now()) {
+			respondError(c, http.StatusBadRequest, errcode.ExpiryInPast)
+			return
+		}
+		expiresAt = &t
+	}
+	prefix, err := randomToken(6)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.KeyGenerationFailed)
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.KeyGenerationFailed)
+		return
+	}
+	// The prefix must not contain the separator.
+	prefix = strings.ReplaceAll(prefix, "_", "x")
+	key := apiKeyPrefix + prefix + "_" + secret
+	k := models.APIKey{
+		UserID:    u.ID,
+		Name:      req.Name,
+		Prefix:    apiKeyPrefix + prefix,
+		KeyHash:   hashToken(key),
+		Scopes:    strings.Join(req.Scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&k).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityAPIKey, k.ID, nil, k)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, APIKeyResponse{APIKey: k, Key: key})
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	u, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	keyID, err := strconv.Atoi(c.Param("keyID"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var k models.APIKey
+	if err := db.DB.Where("id = ? and user_id = ? and revoked_at is null", keyID, u.ID).First(&k).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	before := k
+	now := time.Now()
+	k.RevokedAt = &now
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&k).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditDelete, entityAPIKey, k.ID, before, k)
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
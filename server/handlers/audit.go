@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditVoid    = "void"
+	auditReverse = "reverse"
+	auditOpen    = "open"
+	auditClose   = "close"
+	// auditPassword and auditRecoveryCodes mark changes to a user's
+	// credentials; the snapshots never hold the secrets themselves.
+	auditPassword      = "change_password"
+	auditRecoveryCodes = "recovery_codes"
+)
+
+const (
+	entityBuilding       = "building"
+	entityRoom           = "room"
+	entityStudent        = "student"
+	entityPayment        = "payment"
+	entityUser           = "user"
+	entityAPIKey         = "api_key"
+	entityFeeSchedule    = "fee_schedule"
+	entityBill           = "bill"
+	entityBillAdjustment = "bill_adjustment"
+	entityTerm           = "term"
+	entityDeposit        = "deposit_transaction"
+)
+
+const ctxRequestID = "requestID"
+
+// RequestID tags every request with an ID, reusing the caller's X-Request-ID
+// when it looks sane, and echoes it in the response.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id, _ = randomToken(12)
+		}
+		c.Set(ctxRequestID, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+func snapshot(v interface{}) (*models.JSONText, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	text := models.JSONText(data)
+	return &text, nil
+}
+
+// writeAudit records a change in tx, so the entry commits or rolls back
+// together with the change itself. Pass nil for a missing before or after,
+// and a nil c for background jobs, which are recorded without a user.
+func writeAudit(tx *gorm.DB, c *gin.Context, action, entity string, id uint, before, after interface{}) error {
+	b, err := snapshot(before)
+	if err != nil {
+		return err
+	}
+	a, err := snapshot(after)
+	if err != nil {
+		return err
+	}
+	entry := models.AuditLog{
+		Action:     action,
+		EntityType: entity,
+		EntityID:   id,
+		Before:     b,
+		After:      a,
+	}
+	if c != nil {
+		me, _ := currentUser(c)
+		entry.UserID = me.ID
+		entry.Username = me.Username
+		entry.IP = c.ClientIP()
+		entry.RequestID = c.GetString(ctxRequestID)
+	}
+	return tx.Create(&entry).Error
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, v)
+	}
+	return t, err
+}
+
+func ListAuditLogs(c *gin.Context) {
+	var list []models.AuditLog
+	query := db.DB.Model(&models.AuditLog{}).Order("id desc")
+	if v := c.Query("entityType"); v != "" {
+		query = query.Where("entity_type = ?", v)
+	}
+	if v := c.Query("entityID"); v != "" {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			query = query.Where("entity_id = ?", id)
+		}
+	}
+	if v := c.Query("userID"); v != "" {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			query = query.Where("user_id = ?", id)
+		}
+	}
+	if v := c.Query("action"); v != "" {
+		query = query.Where("action = ?", v)
+	}
+	if v := c.Query("from"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "from"})
+			return
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "to"})
+			return
+		}
+		// A bare date means the whole day.
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	if applyPagination(c, query, &list) {
+		return
+	}
+}
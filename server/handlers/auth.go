@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
@@ -8,8 +10,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 
-	"dormsystem/config"
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
 )
 
@@ -19,65 +21,121 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token              string `json:"token"`
+	RefreshToken       string `json:"refreshToken"`
+	ExpiresIn          int64  `json:"expiresIn"`
+	MustChangePassword bool   `json:"mustChangePassword,omitempty"`
+	MustEnrollTOTP     bool   `json:"mustEnrollTOTP,omitempty"`
 }
 
-func ensureAdminUser() {
+type AuthClaims struct {
+	UserID   uint   `json:"uid"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	// MustChangePassword limits the token to the password change endpoint.
+	MustChangePassword bool `json:"pwc,omitempty"`
+	// MustEnrollTOTP limits the token to the 2FA enrollment endpoints.
+	MustEnrollTOTP bool `json:"mfa,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func InitAuthData() {
 	var count int64
-	db.DB.Model(&models.User{}).Count(&count)
+	db.DB.Model(&models.User{}).Where("role = ?", RoleAdmin).Count(&count)
 	if count == 0 {
-		hash, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
-		if err != nil {
-			return
-		}
-		u := models.User{
-			Username:     "admin",
-			Name:         "管理员",
-			PasswordHash: string(hash),
-			Role:         "admin",
-		}
-		db.DB.Create(&u)
+		log.Println("no admin user exists, run `dormsystem bootstrap -username <name>` to create one")
 	}
+	startTokenPurger()
 }
 
-func InitAuthData() {
-	ensureAdminUser()
+// BootstrapAdmin creates the first admin account. It refuses to run once any
+// admin exists. When password is empty a random one is generated; either way
+// the admin must change it on first login.
+func BootstrapAdmin(username, name, password string) (string, error) {
+	if username == "" {
+		return "", errors.New("username is required")
+	}
+	if name == "" {
+		name = username
+	}
+	var count int64
+	if err := db.DB.Model(&models.User{}).Where("role = ?", RoleAdmin).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", errors.New("an admin user already exists")
+	}
+	if password == "" {
+		var err error
+		if password, err = randomToken(12); err != nil {
+			return "", err
+		}
+	} else if perr := checkPasswordPolicy(username, password); perr != nil {
+		return "", perr
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	u := models.User{
+		Username:           username,
+		Name:               name,
+		PasswordHash:       string(hash),
+		Role:               RoleAdmin,
+		MustChangePassword: true,
+		Version:            1,
+	}
+	if err := db.DB.Create(&u).Error; err != nil {
+		return "", err
+	}
+	return password, nil
 }
 
 func Login(c *gin.Context) {
 	var req LoginRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
 	var u models.User
-	if err := db.DB.Where("username = ?", req.Username).First(&u).Error; err != nil {
-		if req.Username == "root" && req.Password == "root" {
-			c.JSON(http.StatusOK, LoginResponse{Token: "dummy-token"})
-			return
-		}
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+	if err := db.DB.Where("username = ? and not service_account", req.Username).First(&u).Error; err != nil {
+		respondError(c, http.StatusUnauthorized, errcode.InvalidCredentials)
+		return
+	}
+	if u.LockedUntil != nil && time.Now().Before(*u.LockedUntil) {
+		log.Printf("login rejected for locked account %q from %s", u.Username, c.ClientIP())
+		respondError(c, http.StatusLocked, errcode.AccountLocked)
 		return
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)); err != nil {
-		if req.Username == "root" && req.Password == "root" {
-			c.JSON(http.StatusOK, LoginResponse{Token: "dummy-token"})
+		recordLoginFailure(c, u)
+		respondError(c, http.StatusUnauthorized, errcode.InvalidCredentials)
+		return
+	}
+	if u.TOTPEnabled {
+		token, err := newLoginChallenge(u)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, errcode.LoginFailed)
 			return
 		}
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+		c.JSON(http.StatusOK, TwoFactorChallenge{
+			TwoFactorRequired: true,
+			ChallengeToken:    token,
+			ExpiresIn:         int64(loginChallengeTTL.Seconds()),
+		})
 		return
 	}
-	cfg := config.Load()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":      u.ID,
-		"username": u.Username,
-		"role":     u.Role,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-	})
-	tokenStr, err := token.SignedString([]byte(cfg.JWTSecret))
+	finishLogin(c, u)
+}
+
+// finishLogin runs once every required factor has been checked.
+func finishLogin(c *gin.Context, u models.User) {
+	if u.FailedLoginCount > 0 || u.LockedUntil != nil {
+		db.DB.Model(&u).Updates(map[string]interface{}{"failed_login_count": 0, "locked_until": nil})
+	}
+	resp, err := issueSession(db.DB, u)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "登录失败"})
+		respondError(c, http.StatusInternalServerError, errcode.LoginFailed)
 		return
 	}
-	c.JSON(http.StatusOK, LoginResponse{Token: tokenStr})
+	c.JSON(http.StatusOK, resp)
 }
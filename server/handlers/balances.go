@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+// BalanceLine compares what was charged with what was paid for one fee item
+// in one term. A positive Balance is owed; a negative one is credit.
+// Payments outside every term are listed with a null TermID.
+type BalanceLine struct {
+	TermID   *uint   `json:"termID"`
+	TermName string  `json:"termName"`
+	FeeType  string  `json:"feeType"`
+	Charged  float64 `json:"charged"`
+	Paid     float64 `json:"paid"`
+	Balance  float64 `json:"balance"`
+}
+
+// ArrearsLine is one student owing money on one fee item in one term.
+type ArrearsLine struct {
+	StudentID uint   `json:"studentID"`
+	StudentNo string `json:"studentNo"`
+	Name      string `json:"name"`
+	BalanceLine
+}
+
+const balanceColumns = "t.name as term_name, sum(l.charged) as charged, sum(l.paid) as paid, sum(l.charged) - sum(l.paid) as balance"
+
+// ledger reads v_fee_ledger with the term names, narrowed by the ?termID
+// and ?feeType filters.
+func ledger(c *gin.Context) *gorm.DB {
+	query := db.DB.Table("v_fee_ledger l").Joins("LEFT JOIN terms t ON t.id = l.term_id")
+	termIDStr := c.Query("termID")
+	if termIDStr != "" {
+		if id, err := strconv.Atoi(termIDStr); err == nil && id > 0 {
+			query = query.Where("l.term_id = ?", id)
+		}
+	}
+	if feeType := c.Query("feeType"); feeType != "" {
+		query = query.Where("l.fee_type = ?", feeType)
+	}
+	return query
+}
+
+// respondBalance lists the balance lines of the ledger rows whose column
+// equals id.
+func respondBalance(c *gin.Context, column string, id uint) {
+	lines := ledger(c).
+		Select("l.term_id, l.fee_type, "+balanceColumns).
+		Where("l."+column+" = ?", id).
+		Group("l.term_id, t.name, l.fee_type")
+	var list []BalanceLine
+	if applyPagination(c, db.DB.Table("(?) as b", lines).Order("term_id, fee_type"), &list) {
+		return
+	}
+}
+
+func GetStudentBalance(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	// Checked-out students can still owe or be owed money.
+	var s models.Student
+	if err := db.DB.Unscoped().First(&s, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID) {
+		return
+	}
+	respondBalance(c, "student_id", s.ID)
+}
+
+// GetRoomBalance covers everyone billed for the room, including students who
+// have since moved out.
+func GetRoomBalance(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var r models.DormRoom
+	if err := db.DB.First(&r, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	respondBalance(c, "room_id", r.ID)
+}
+
+// ListBuildingArrears lists the students of a building who owe money, the
+// largest debts first. ?minAmount hides smaller balances.
+func ListBuildingArrears(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var b models.ApartmentBuilding
+	if err := db.DB.First(&b, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, b.ID) {
+		return
+	}
+	minAmount := 0.0
+	if v, err := strconv.ParseFloat(c.Query("minAmount"), 64); err == nil && v > 0 {
+		minAmount = v
+	}
+	lines := ledger(c).
+		Select("l.student_id, s.student_no, s.name, l.term_id, l.fee_type, "+balanceColumns).
+		Joins("JOIN students s ON s.id = l.student_id").
+		Where("l.building_id = ?", b.ID).
+		Group("l.student_id, s.student_no, s.name, l.term_id, t.name, l.fee_type")
+	if minAmount > 0 {
+		lines = lines.Having("sum(l.charged) - sum(l.paid) >= ?", minAmount)
+	} else {
+		lines = lines.Having("sum(l.charged) - sum(l.paid) > 0")
+	}
+	if keyword := c.Query("keyword"); keyword != "" {
+		lines = lines.Where(db.DB.Where("s.student_no = ?", keyword).Or("s.name = ?", keyword))
+	}
+	var list []ArrearsLine
+	if applyPagination(c, db.DB.Table("(?) as a", lines).Order("balance desc, student_id, term_id, fee_type"), &list) {
+		return
+	}
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+	"dormsystem/validation"
+)
+
+// billsView reads bills together with their adjustments and what has been
+// paid on them.
+func billsView(tx *gorm.DB) *gorm.DB {
+	return tx.Table("v_bills")
+}
+
+func ListBills(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
+	var list []models.Bill
+	query := scope.apply(billsView(db.DB), "building_id")
+	termIDStr := c.Query("termID")
+	if termIDStr != "" {
+		if id, err := strconv.Atoi(termIDStr); err == nil && id > 0 {
+			query = query.Where("term_id = ?", id)
+		}
+	}
+	if feeType := c.Query("feeType"); feeType != "" {
+		query = query.Where("fee_type = ?", feeType)
+	}
+	buildingIDStr := c.Query("buildingID")
+	if buildingIDStr != "" {
+		if id, err := strconv.Atoi(buildingIDStr); err == nil && id > 0 {
+			query = query.Where("building_id = ?", id)
+		}
+	}
+	roomIDStr := c.Query("roomID")
+	if roomIDStr != "" {
+		if id, err := strconv.Atoi(roomIDStr); err == nil && id > 0 {
+			query = query.Where("room_id = ?", id)
+		}
+	}
+	studentIDStr := c.Query("studentID")
+	if studentIDStr != "" {
+		if id, err := strconv.Atoi(studentIDStr); err == nil && id > 0 {
+			query = query.Where("student_id = ?", id)
+		}
+	}
+	if settled, err := strconv.ParseBool(c.Query("settled")); err == nil {
+		query = query.Where("settled = ?", settled)
+	}
+	if overpaid, err := strconv.ParseBool(c.Query("overpaid")); err == nil {
+		if overpaid {
+			query = query.Where("overpaid_amount > 0")
+		} else {
+			query = query.Where("overpaid_amount = 0")
+		}
+	}
+	if applyPagination(c, query.Order("id"), &list) {
+		return
+	}
+}
+
+func GetBill(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var b models.Bill
+	if err := billsView(db.DB).Where("id = ?", id).First(&b).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, b.BuildingID) {
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// matchFeeSchedule picks the schedule of feeType that applies to room r:
+// one naming the room, then one for its room type in its building, then one
+// for its room type anywhere, then one for its building.
+func matchFeeSchedule(list []models.FeeSchedule, feeType string, r models.DormRoom) *models.FeeSchedule {
+	var best *models.FeeSchedule
+	bestRank := 0
+	for i := range list {
+		fs := &list[i]
+		if fs.FeeType != feeType {
+			continue
+		}
+		rank := 0
+		switch {
+		case fs.RoomID != nil:
+			if *fs.RoomID == r.ID {
+				rank = 4
+			}
+		case fs.RoomType != "":
+			if fs.RoomType != r.RoomType {
+				break
+			}
+			if fs.BuildingID == nil {
+				rank = 2
+			} else if *fs.BuildingID == r.BuildingID {
+				rank = 3
+			}
+		case fs.BuildingID != nil:
+			if *fs.BuildingID == r.BuildingID {
+				rank = 1
+			}
+		}
+		if rank > bestRank {
+			best, bestRank = fs, rank
+		}
+	}
+	return best
+}
+
+type BillingRunRequest struct {
+	TermID uint `json:"termID"`
+	// FeeType and BuildingID narrow the run; empty means every fee item and
+	// every building the caller may change.
+	FeeType    string `json:"feeType"`
+	BuildingID uint   `json:"buildingID"`
+}
+
+type BillingRunResult struct {
+	Created int `json:"created"`
+	// Skipped occupants already have the bill; Unpriced ones have no
+	// schedule that applies to their room. Adjusted accommodation bills were
+	// re-prorated after the student moved, and Overpaid lists those that
+	// were already paid beyond what is now due.
+	Skipped  int            `json:"skipped"`
+	Unpriced int            `json:"unpriced"`
+	Adjusted int            `json:"adjusted"`
+	Overpaid []OverpaidBill `json:"overpaid"`
+}
+
+// OverpaidBill is a bill paid beyond what is due after an adjustment. The
+// difference is owed back to the student.
+type OverpaidBill struct {
+	BillID    uint    `json:"billID"`
+	StudentID uint    `json:"studentID"`
+	Amount    float64 `json:"amount"`
+}
+
+// RunBilling charges the fee items of an open term according to the
+// schedules. Accommodation is prorated over everyone who stayed in a room
+// during the term; the other items are charged in full to the current
+// occupants. It can be run again after schedules or occupants change:
+// other bills that already exist are left alone.
+func RunBilling(c *gin.Context) {
+	var req BillingRunRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var errs validation.Errors
+	if req.TermID == 0 {
+		errs.Add("termID", errcode.Required)
+	}
+	feeTypes := models.FeeTypes
+	if req.FeeType != "" {
+		if !containsString(models.FeeTypes, req.FeeType) {
+			errs.Add("feeType", errcode.InvalidPaymentType)
+		}
+		feeTypes = []string{req.FeeType}
+	}
+	if invalid(c, errs) {
+		return
+	}
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
+	if req.BuildingID != 0 && !requireBuildings(c, req.BuildingID) {
+		return
+	}
+	var t models.Term
+	if err := db.DB.First(&t, req.TermID).Error; err != nil {
+		respondError(c, http.StatusBadRequest, errcode.TermNotFound)
+		return
+	}
+	prorated := containsString(feeTypes, models.FeeAccommodation)
+	var fullTypes []string
+	for _, feeType := range feeTypes {
+		if feeType != models.FeeAccommodation {
+			fullTypes = append(fullTypes, feeType)
+		}
+	}
+	var schedules []models.FeeSchedule
+	if err := db.DB.Where("term_id = ? and fee_type in ?", t.ID, fullTypes).Find(&schedules).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	studentQuery := scope.apply(db.DB.Model(&models.Student{}), "building_id").Where("room_id <> 0")
+	if req.BuildingID != 0 {
+		studentQuery = studentQuery.Where("building_id = ?", req.BuildingID)
+	}
+	var students []models.Student
+	if err := studentQuery.Order("id").Find(&students).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	roomIDs := make([]uint, 0, len(students))
+	for _, s := range students {
+		roomIDs = append(roomIDs, s.RoomID)
+	}
+	var rooms []models.DormRoom
+	if err := db.DB.Where("id in ?", roomIDs).Find(&rooms).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	roomByID := map[uint]models.DormRoom{}
+	for _, r := range rooms {
+		roomByID[r.ID] = r
+	}
+	var existing []models.Bill
+	if err := db.DB.Where("term_id = ? and fee_type in ?", t.ID, fullTypes).Find(&existing).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	billed := map[string]bool{}
+	billKey := func(feeType string, studentID, roomID uint) string {
+		return feeType + "/" + strconv.Itoa(int(studentID)) + "/" + strconv.Itoa(int(roomID))
+	}
+	for _, b := range existing {
+		billed[billKey(b.FeeType, b.StudentID, b.RoomID)] = true
+	}
+	var result BillingRunResult
+	var bills []models.Bill
+	for _, s := range students {
+		r, ok := roomByID[s.RoomID]
+		if !ok {
+			continue
+		}
+		for _, feeType := range fullTypes {
+			if billed[billKey(feeType, s.ID, r.ID)] {
+				result.Skipped++
+				continue
+			}
+			fs := matchFeeSchedule(schedules, feeType, r)
+			if fs == nil {
+				result.Unpriced++
+				continue
+			}
+			bills = append(bills, models.Bill{
+				TermID:        t.ID,
+				FeeType:       feeType,
+				StudentID:     s.ID,
+				BuildingID:    r.BuildingID,
+				RoomID:        r.ID,
+				FeeScheduleID: &fs.ID,
+				Amount:        fs.Amount,
+				FullAmount:    fs.Amount,
+			})
+		}
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenTerm(tx, t.ID); err != nil {
+			return err
+		}
+		for i := range bills {
+			if err := tx.Create(&bills[i]).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditCreate, entityBill, bills[i].ID, nil, bills[i]); err != nil {
+				return err
+			}
+		}
+		result.Created = len(bills)
+		if !prorated {
+			return nil
+		}
+		stayQuery := scope.apply(tx.Model(&models.StudentStay{}).
+			Joins("JOIN dorm_rooms r ON r.id = student_stays.room_id").
+			Where("student_stays.start_date <= ? and (student_stays.end_date is null or student_stays.end_date > ?)", t.EndDate, t.StartDate),
+			"r.building_id")
+		if req.BuildingID != 0 {
+			stayQuery = stayQuery.Where("r.building_id = ?", req.BuildingID)
+		}
+		var stayers []uint
+		if err := stayQuery.Distinct().Pluck("student_stays.student_id", &stayers).Error; err != nil {
+			return err
+		}
+		allowRoom := func(r models.DormRoom) bool {
+			return scope.allows(r.BuildingID) && (req.BuildingID == 0 || r.BuildingID == req.BuildingID)
+		}
+		return billAccommodation(tx, c, t, stayers, allowRoom, &result)
+	})
+	if respondTermError(c, err) {
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.BillingFailed)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
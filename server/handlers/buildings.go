@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
+	"dormsystem/validation"
 )
 
 type BuildingRequest struct {
@@ -19,8 +23,15 @@ type BuildingRequest struct {
 }
 
 func ListBuildings(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
 	var list []models.ApartmentBuilding
-	query := db.DB.Model(&models.ApartmentBuilding{})
+	query, ok := applyDeletedFilter(c, scope.apply(db.DB.Model(&models.ApartmentBuilding{}), "id"), "deleted_at")
+	if !ok {
+		return
+	}
 	keyword := c.Query("keyword")
 	if keyword != "" {
 		query = query.Where("building_no = ?", keyword)
@@ -32,8 +43,7 @@ func ListBuildings(c *gin.Context) {
 
 func CreateBuilding(c *gin.Context) {
 	var req BuildingRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
 	startedAt, err := time.Parse("2006-01-02", req.StartedAt)
@@ -41,7 +51,7 @@ func CreateBuilding(c *gin.Context) {
 		startedAt, err = time.Parse(time.RFC3339, req.StartedAt)
 	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "启用时间格式应为YYYY-MM-DD"})
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "startedAt"})
 		return
 	}
 	b := models.ApartmentBuilding{
@@ -49,29 +59,62 @@ func CreateBuilding(c *gin.Context) {
 		FloorCount: req.FloorCount,
 		RoomCount:  req.RoomCount,
 		StartedAt:  startedAt,
+		Version:    1,
 	}
-	if err := db.DB.Create(&b).Error; err != nil {
-		respondDBError(c, err, "创建失败")
+	if invalid(c, validation.Building(b)) {
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&b).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityBuilding, b.ID, nil, b)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
 		return
 	}
 	c.JSON(http.StatusOK, b)
 }
 
+func GetBuilding(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var b models.ApartmentBuilding
+	if err := db.DB.First(&b, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, b.ID) {
+		return
+	}
+	respondVersioned(c, b.Version, b)
+}
+
 func UpdateBuilding(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	if !requireBuildings(c, uint(id)) {
 		return
 	}
 	var b models.ApartmentBuilding
 	if err := db.DB.First(&b, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !checkIfMatch(c, b.Version, b) {
 		return
 	}
 	var req BuildingRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
 	startedAt, err := time.Parse("2006-01-02", req.StartedAt)
@@ -79,17 +122,39 @@ func UpdateBuilding(c *gin.Context) {
 		startedAt, err = time.Parse(time.RFC3339, req.StartedAt)
 	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "启用时间格式应为YYYY-MM-DD"})
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "startedAt"})
 		return
 	}
+	before := b
+	version := b.Version
+	b.Version++
 	b.BuildingNo = req.BuildingNo
 	b.FloorCount = req.FloorCount
 	b.RoomCount = req.RoomCount
 	b.StartedAt = startedAt
-	if err := db.DB.Save(&b).Error; err != nil {
-		respondDBError(c, err, "更新失败")
+	if invalid(c, validation.Building(b)) {
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &b, version); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityBuilding, b.ID, before, b)
+	})
+	if errors.Is(err, errStaleVersion) {
+		var cur models.ApartmentBuilding
+		if err := db.DB.First(&cur, b.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
 		return
 	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, b.Version)
 	c.JSON(http.StatusOK, b)
 }
 
@@ -97,11 +162,46 @@ func DeleteBuilding(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	if !requireBuildings(c, uint(id)) {
 		return
 	}
-	if err := db.DB.Delete(&models.ApartmentBuilding{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+	var b models.ApartmentBuilding
+	if err := db.DB.First(&b, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	d, err := countDependencies(db.DB, "building_id", b.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
+		return
+	}
+	cascade, ok := checkDeletable(c, d, b.BuildingNo)
+	if !ok {
+		return
+	}
+	day, ok := moveDate(c)
+	if !ok {
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			if err := cascadeDelete(tx, c, entityStudent, "building_id", b.ID, day); err != nil {
+				return err
+			}
+			if err := cascadeDelete(tx, c, entityRoom, "building_id", b.ID, day); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&b).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditDelete, entityBuilding, b.ID, b, nil)
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+// Dependencies counts the live rows that still point at a building or room.
+type Dependencies struct {
+	Rooms    int64 `json:"rooms"`
+	Students int64 `json:"students"`
+	Payments int64 `json:"payments"`
+	Bills    int64 `json:"bills"`
+}
+
+func (d Dependencies) empty() bool {
+	return d.Rooms == 0 && d.Students == 0 && d.Payments == 0 && d.Bills == 0
+}
+
+// countDependencies counts the rows whose column equals id. Rooms are only
+// counted for buildings.
+func countDependencies(tx *gorm.DB, column string, id uint) (Dependencies, error) {
+	var d Dependencies
+	if column == "building_id" {
+		if err := tx.Model(&models.DormRoom{}).Where("building_id = ?", id).Count(&d.Rooms).Error; err != nil {
+			return d, err
+		}
+	}
+	if err := tx.Model(&models.Student{}).Where(column+" = ?", id).Count(&d.Students).Error; err != nil {
+		return d, err
+	}
+	if err := tx.Model(&models.Payment{}).Where(column+" = ?", id).Count(&d.Payments).Error; err != nil {
+		return d, err
+	}
+	if err := tx.Model(&models.Bill{}).Where(column+" = ?", id).Count(&d.Bills).Error; err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// checkDeletable answers 409 with the breakdown unless the row has no
+// dependents, or the caller asked for ?cascade=true and confirmed it by
+// repeating the row's number in ?confirm. Payments and bills are financial
+// records and always block.
+func checkDeletable(c *gin.Context, d Dependencies, confirmValue string) (cascade bool, ok bool) {
+	if d.empty() {
+		return false, true
+	}
+	if d.Payments > 0 {
+		respondErrorWith(c, http.StatusConflict, errcode.HasPayments, gin.H{"dependencies": d})
+		return false, false
+	}
+	if d.Bills > 0 {
+		respondErrorWith(c, http.StatusConflict, errcode.HasBills, gin.H{"dependencies": d})
+		return false, false
+	}
+	if c.Query("cascade") != "true" {
+		respondErrorWith(c, http.StatusConflict, errcode.HasDependencies, gin.H{"dependencies": d})
+		return false, false
+	}
+	if c.Query("confirm") != confirmValue {
+		respondErrorWith(c, http.StatusBadRequest, errcode.CascadeConfirmationMismatch, gin.H{"dependencies": d})
+		return false, false
+	}
+	return true, true
+}
+
+// cascadeDelete soft deletes and audits the rooms or students whose column
+// equals id. Students are checked out on day and their bills re-prorated.
+func cascadeDelete(tx *gorm.DB, c *gin.Context, entity string, column string, id uint, day time.Time) error {
+	switch entity {
+	case entityRoom:
+		var rooms []models.DormRoom
+		if err := tx.Where(column+" = ?", id).Find(&rooms).Error; err != nil {
+			return err
+		}
+		for _, r := range rooms {
+			if err := tx.Delete(&r).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditDelete, entityRoom, r.ID, r, nil); err != nil {
+				return err
+			}
+		}
+	case entityStudent:
+		var students []models.Student
+		if err := tx.Where(column+" = ?", id).Find(&students).Error; err != nil {
+			return err
+		}
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		for _, s := range students {
+			if err := tx.Delete(&s).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditDelete, entityStudent, s.ID, s, nil); err != nil {
+				return err
+			}
+			if err := rebillStudent(tx, c, s.ID, day); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func GetBuildingDependencies(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	if !requireBuildings(c, uint(id)) {
+		return
+	}
+	var b models.ApartmentBuilding
+	if err := db.DB.First(&b, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	d, err := countDependencies(db.DB, "building_id", b.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func GetRoomDependencies(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var r models.DormRoom
+	if err := db.DB.First(&r, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	d, err := countDependencies(db.DB, "room_id", r.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+	"dormsystem/validation"
+)
+
+// DepositEntry is one movement of a student's deposit. Amounts received are
+// positive; reversals, refunds and deductions are negative.
+type DepositEntry struct {
+	EntryDate     time.Time `json:"entryDate"`
+	Kind          string    `json:"kind"`
+	Description   string    `json:"description"`
+	Amount        float64   `json:"amount"`
+	BuildingID    uint      `json:"buildingID"`
+	RoomID        uint      `json:"roomID"`
+	PaymentID     *uint     `json:"paymentID"`
+	TransactionID *uint     `json:"transactionID"`
+}
+
+type DepositLedger struct {
+	StudentID uint           `json:"studentID"`
+	Received  float64        `json:"received"`
+	Refunded  float64        `json:"refunded"`
+	Deducted  float64        `json:"deducted"`
+	Held      float64        `json:"held"`
+	Entries   []DepositEntry `json:"entries"`
+}
+
+type DepositRefundRequest struct {
+	// Amount defaults to everything still held.
+	Amount      float64 `json:"amount"`
+	OccurredAt  string  `json:"occurredAt"`
+	Description string  `json:"description"`
+}
+
+type DepositItem struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+type DepositDeductionRequest struct {
+	OccurredAt string        `json:"occurredAt"`
+	Items      []DepositItem `json:"items"`
+}
+
+type DepositVoidRequest struct {
+	Reason string `json:"reason"`
+}
+
+type BuildingDepositSummary struct {
+	BuildingID     uint    `json:"buildingID"`
+	BuildingNo     string  `json:"buildingNo"`
+	ReceivedAmount float64 `json:"receivedAmount"`
+	RefundedAmount float64 `json:"refundedAmount"`
+	DeductedAmount float64 `json:"deductedAmount"`
+	HeldAmount     float64 `json:"heldAmount"`
+}
+
+// errDepositExceeded is returned when a refund or deductions come to more
+// than the deposit held.
+var errDepositExceeded = errors.New("deposit exceeded")
+
+// loadDepositStudent reads the student named by :id. Students who have
+// checked out are included, since their deposit is settled afterwards.
+func loadDepositStudent(c *gin.Context, s *models.Student) bool {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return false
+	}
+	if err := db.DB.Unscoped().First(s, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return false
+	}
+	return requireBuildings(c, s.BuildingID)
+}
+
+// depositDate is the occurredAt of a request, defaulting to today.
+func depositDate(c *gin.Context, v string) (time.Time, bool) {
+	if v == "" {
+		y, m, d := time.Now().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), true
+	}
+	day, err := parseTimeParam(v)
+	if err != nil {
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "occurredAt"})
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// depositHeld is what is left of the student's deposit. It locks the
+// student so that concurrent refunds and deductions cannot overdraw it.
+func depositHeld(tx *gorm.DB, studentID uint) (float64, error) {
+	if err := tx.Exec("select id from students where id = ? for update", studentID).Error; err != nil {
+		return 0, err
+	}
+	var held float64
+	err := tx.Table("v_deposit_ledger").Where("student_id = ?", studentID).
+		Select("coalesce(sum(amount), 0)").Scan(&held).Error
+	return held, err
+}
+
+// postDepositTransactions writes list for student s after checking that the
+// deposit covers them. An amount of 0 on a single refund takes everything
+// held.
+func postDepositTransactions(c *gin.Context, s models.Student, list []models.DepositTransaction) {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		held, err := depositHeld(tx, s.ID)
+		if err != nil {
+			return err
+		}
+		if len(list) == 1 && list[0].Kind == models.DepositRefund && list[0].Amount == 0 {
+			list[0].Amount = roundFen(held)
+		}
+		total := 0.0
+		for _, d := range list {
+			total += d.Amount
+		}
+		// Amounts are in yuan; allow for float rounding below a fen.
+		if total <= 0 || total > held+0.005 {
+			return errDepositExceeded
+		}
+		for i := range list {
+			if err := tx.Create(&list[i]).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditCreate, entityDeposit, list[i].ID, nil, list[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errDepositExceeded) {
+		if len(list) == 1 && list[0].Kind == models.DepositRefund && list[0].Amount <= 0 {
+			respondError(c, http.StatusConflict, errcode.NoDepositHeld)
+		} else {
+			respondError(c, http.StatusConflict, errcode.DepositExceedsHeld)
+		}
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetStudentDeposit lists every movement of a student's deposit, oldest
+// first, with what is still held.
+func GetStudentDeposit(c *gin.Context) {
+	var s models.Student
+	if !loadDepositStudent(c, &s) {
+		return
+	}
+	ledger := DepositLedger{StudentID: s.ID, Entries: []DepositEntry{}}
+	err := db.DB.Table("v_deposit_ledger").Where("student_id = ?", s.ID).
+		Order("entry_date, payment_id, transaction_id").Scan(&ledger.Entries).Error
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	for _, e := range ledger.Entries {
+		switch e.Kind {
+		case models.DepositRefund:
+			ledger.Refunded -= e.Amount
+		case models.DepositDeduction:
+			ledger.Deducted -= e.Amount
+		default:
+			ledger.Received += e.Amount
+		}
+		ledger.Held += e.Amount
+	}
+	ledger.Received = roundFen(ledger.Received)
+	ledger.Refunded = roundFen(ledger.Refunded)
+	ledger.Deducted = roundFen(ledger.Deducted)
+	ledger.Held = roundFen(ledger.Held)
+	c.JSON(http.StatusOK, ledger)
+}
+
+// RefundDeposit pays deposit back to a student, usually at checkout after
+// any deductions.
+func RefundDeposit(c *gin.Context) {
+	var s models.Student
+	if !loadDepositStudent(c, &s) {
+		return
+	}
+	var req DepositRefundRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	day, ok := depositDate(c, req.OccurredAt)
+	if !ok {
+		return
+	}
+	d := models.DepositTransaction{
+		StudentID:   s.ID,
+		BuildingID:  s.BuildingID,
+		RoomID:      s.RoomID,
+		Kind:        models.DepositRefund,
+		Description: strings.TrimSpace(req.Description),
+		Amount:      req.Amount,
+		OccurredAt:  day,
+		Status:      models.PaymentPosted,
+	}
+	if req.Amount != 0 && invalid(c, validation.DepositTransaction(d)) {
+		return
+	}
+	postDepositTransactions(c, s, []models.DepositTransaction{d})
+}
+
+// DeductDeposit withholds deposit for damages, one transaction per item.
+func DeductDeposit(c *gin.Context) {
+	var s models.Student
+	if !loadDepositStudent(c, &s) {
+		return
+	}
+	var req DepositDeductionRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if len(req.Items) == 0 {
+		respondError(c, http.StatusBadRequest, errcode.DepositItemsRequired)
+		return
+	}
+	day, ok := depositDate(c, req.OccurredAt)
+	if !ok {
+		return
+	}
+	list := make([]models.DepositTransaction, 0, len(req.Items))
+	var errs validation.Errors
+	for i, item := range req.Items {
+		d := models.DepositTransaction{
+			StudentID:   s.ID,
+			BuildingID:  s.BuildingID,
+			RoomID:      s.RoomID,
+			Kind:        models.DepositDeduction,
+			Description: strings.TrimSpace(item.Description),
+			Amount:      item.Amount,
+			OccurredAt:  day,
+			Status:      models.PaymentPosted,
+		}
+		for _, fe := range validation.DepositTransaction(d) {
+			fe.Field = fmt.Sprintf("items[%d].%s", i, fe.Field)
+			errs = append(errs, fe)
+		}
+		list = append(list, d)
+	}
+	if invalid(c, errs) {
+		return
+	}
+	postDepositTransactions(c, s, list)
+}
+
+// VoidDepositTransaction cancels a refund or deduction entered by mistake.
+// The row stays for the audit trail and the amount is held again.
+func VoidDepositTransaction(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var d models.DepositTransaction
+	if err := db.DB.First(&d, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, d.BuildingID) {
+		return
+	}
+	var req DepositVoidRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		respondError(c, http.StatusBadRequest, errcode.ReasonRequired)
+		return
+	}
+	if d.Status != models.PaymentPosted {
+		respondError(c, http.StatusConflict, errcode.DepositAlreadyVoided)
+		return
+	}
+	before := d
+	now := time.Now()
+	d.Status = models.PaymentVoided
+	d.Reason = req.Reason
+	d.VoidedAt = &now
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&d).Where("status = ?", models.PaymentPosted).Updates(map[string]interface{}{
+			"status":    d.Status,
+			"reason":    d.Reason,
+			"voided_at": d.VoidedAt,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errStaleVersion
+		}
+		return writeAudit(tx, c, auditVoid, entityDeposit, d.ID, before, d)
+	})
+	if errors.Is(err, errStaleVersion) {
+		respondError(c, http.StatusConflict, errcode.DepositAlreadyVoided)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.VoidFailed)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// GetBuildingDepositSummary reports the deposits received, refunded,
+// deducted and still held for the students of each building.
+func GetBuildingDepositSummary(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
+	var list []BuildingDepositSummary
+	query := scope.apply(db.DB.Table("v_building_deposits"), "building_id").
+		Select("building_id, building_no, received_amount, refunded_amount, deducted_amount, held_amount")
+	if err := query.Scan(&list).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
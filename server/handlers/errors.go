@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	pgxpgconn "github.com/jackc/pgx/v5/pgconn"
+
+	"dormsystem/errcode"
+)
+
+// requestLang is the language error messages are written in for c.
+func requestLang(c *gin.Context) string {
+	return errcode.Lang(c.GetHeader("Accept-Language"))
+}
+
+func errorBody(c *gin.Context, code errcode.Code, args ...interface{}) gin.H {
+	lang := requestLang(c)
+	c.Header("Content-Language", lang)
+	return gin.H(errcode.Body(code, lang, args...))
+}
+
+// respondError answers status with code and its localized message.
+func respondError(c *gin.Context, status int, code errcode.Code, args ...interface{}) {
+	c.JSON(status, errorBody(c, code, args...))
+}
+
+// respondErrorWith adds extra keys, such as the current row or the field
+// errors, to the error body.
+func respondErrorWith(c *gin.Context, status int, code errcode.Code, extra gin.H) {
+	body := errorBody(c, code)
+	for k, v := range extra {
+		body[k] = v
+	}
+	c.JSON(status, body)
+}
+
+func abortError(c *gin.Context, status int, code errcode.Code) {
+	c.AbortWithStatusJSON(status, errorBody(c, code))
+}
+
+type dbError struct {
+	status int
+	code   errcode.Code
+}
+
+// dbErrors maps the constraints of the schema, and the constraint names the
+// triggers raise with, to API errors.
+var dbErrors = map[string]dbError{
+	"chk_building_floor_count":         {http.StatusBadRequest, errcode.InvalidFloorCount},
+	"chk_building_room_count":          {http.StatusBadRequest, errcode.InvalidRoomCount},
+	"chk_room_capacity":                {http.StatusBadRequest, errcode.InvalidRoomCapacity},
+	"chk_room_fee_nonnegative":         {http.StatusBadRequest, errcode.InvalidRoomFee},
+	"chk_student_gender":               {http.StatusBadRequest, errcode.InvalidGender},
+	"chk_payment_amount_sign":          {http.StatusBadRequest, errcode.AmountNotPositive},
+	"chk_payment_type":                 {http.StatusBadRequest, errcode.InvalidPaymentType},
+	"idx_buildings_building_no_active": {http.StatusConflict, errcode.DuplicateBuildingNo},
+	"idx_rooms_building_room_no":       {http.StatusConflict, errcode.DuplicateRoomNo},
+	"idx_students_student_no_active":   {http.StatusConflict, errcode.DuplicateStudentNo},
+	"idx_payments_payment_no_active":   {http.StatusConflict, errcode.DuplicatePaymentNo},
+	"idx_users_username":               {http.StatusConflict, errcode.DuplicateUsername},
+	"chk_fee_schedule_type":            {http.StatusBadRequest, errcode.InvalidPaymentType},
+	"chk_fee_schedule_amount":          {http.StatusBadRequest, errcode.AmountNegative},
+	"chk_fee_schedule_target":          {http.StatusBadRequest, errcode.InvalidFeeScheduleTarget},
+	"idx_fee_schedules_target":         {http.StatusConflict, errcode.DuplicateFeeSchedule},
+	"idx_bills_occupant":               {http.StatusConflict, errcode.DuplicateBill},
+	"fk_payments_bill":                 {http.StatusBadRequest, errcode.BillNotFound},
+	"chk_term_dates":                   {http.StatusBadRequest, errcode.TermDatesInvalid},
+	"idx_terms_name":                   {http.StatusConflict, errcode.DuplicateTermName},
+	"fk_fee_schedules_term":            {http.StatusBadRequest, errcode.TermNotFound},
+	"fk_bills_term":                    {http.StatusBadRequest, errcode.TermNotFound},
+	"fk_payments_term":                 {http.StatusBadRequest, errcode.TermNotFound},
+	"chk_deposit_kind":                 {http.StatusBadRequest, errcode.InvalidDepositKind},
+	"chk_deposit_amount":               {http.StatusBadRequest, errcode.AmountNotPositive},
+	"chk_deposit_description":          {http.StatusBadRequest, errcode.Required},
+	"fk_deposit_transactions_room":     {http.StatusBadRequest, errcode.RoomNotFound},
+	"deposit_immutable":                {http.StatusConflict, errcode.DepositImmutable},
+	"deposit_voided":                   {http.StatusConflict, errcode.DepositAlreadyVoided},
+	"room_exists":                      {http.StatusBadRequest, errcode.RoomNotFound},
+	"room_capacity":                    {http.StatusBadRequest, errcode.RoomFull},
+	"payment_no_delete":                {http.StatusConflict, errcode.PaymentImmutable},
+	"payment_immutable":                {http.StatusConflict, errcode.PaymentImmutable},
+	"payment_corrected":                {http.StatusConflict, errcode.PaymentAlreadyCorrected},
+}
+
+// respondDBError answers with the API error for the constraint err violated,
+// or 500 with fallback.
+func respondDBError(c *gin.Context, err error, fallback errcode.Code) {
+	var pgErr *pgxpgconn.PgError
+	if errors.As(err, &pgErr) {
+		if e, ok := dbErrors[pgErr.ConstraintName]; ok {
+			respondError(c, e.status, e.code)
+			return
+		}
+	}
+	respondError(c, http.StatusInternalServerError, fallback)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/errcode"
+)
+
+// errStaleVersion is returned by saveVersioned when another request updated
+// the row since it was read.
+var errStaleVersion = errors.New("stale version")
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func setETag(c *gin.Context, version int) {
+	c.Header("ETag", etag(version))
+}
+
+// checkIfMatch requires an If-Match header naming the current version. It
+// answers 428 when the header is missing and 412 with the current row when
+// it is stale.
+func checkIfMatch(c *gin.Context, version int, current interface{}) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		respondError(c, http.StatusPreconditionRequired, errcode.IfMatchRequired)
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	respondStale(c, version, current)
+	return false
+}
+
+func respondStale(c *gin.Context, version int, current interface{}) {
+	setETag(c, version)
+	respondErrorWith(c, http.StatusPreconditionFailed, errcode.VersionConflict, gin.H{"current": current})
+}
+
+// saveVersioned writes every column of value, or only columns if any are
+// given, along with version+1, which value must already carry, but only if
+// the row is still at version.
+func saveVersioned(tx *gorm.DB, value interface{}, version int, columns ...string) error {
+	query := tx.Model(value).Where("version = ?", version)
+	if len(columns) == 0 {
+		query = query.Select("*").Omit("id", "deleted_at")
+	} else {
+		if !containsString(columns, "version") {
+			columns = append(columns, "version")
+		}
+		query = query.Select(columns)
+	}
+	res := query.Updates(value)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStaleVersion
+	}
+	return nil
+}
+
+// respondVersioned sends a single row with its ETag, or 304 when the client
+// already holds that version.
+func respondVersioned(c *gin.Context, version int, body interface{}) {
+	setETag(c, version)
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag(version) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	c.JSON(http.StatusOK, body)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"dormsystem/errcode"
+)
+
+// ifMatch runs checkIfMatch for a row at version 3 with the given If-Match
+// header, or none when it is empty.
+func ifMatch(header string) (bool, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPut, "/", nil)
+	if header != "" {
+		c.Request.Header.Set("If-Match", header)
+	}
+	return checkIfMatch(c, 3, gin.H{"id": 1, "version": 3}), w
+}
+
+func TestCheckIfMatchAccepts(t *testing.T) {
+	for _, header := range []string{`"3"`, `W/"3"`, `"2", "3"`, `*`} {
+		if ok, w := ifMatch(header); !ok || w.Body.Len() != 0 {
+			t.Errorf("If-Match %s: ok %v, body %s", header, ok, w.Body)
+		}
+	}
+}
+
+func TestCheckIfMatchMissing(t *testing.T) {
+	ok, w := ifMatch("")
+	if ok || w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("no If-Match: ok %v, status %d, want 428", ok, w.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["code"] != string(errcode.IfMatchRequired) {
+		t.Errorf("code %v, want %s", body["code"], errcode.IfMatchRequired)
+	}
+}
+
+func TestCheckIfMatchStale(t *testing.T) {
+	for _, header := range []string{`"2"`, `3`, `"4", W/"5"`} {
+		ok, w := ifMatch(header)
+		if ok || w.Code != http.StatusPreconditionFailed {
+			t.Errorf("If-Match %s: ok %v, status %d, want 412", header, ok, w.Code)
+			continue
+		}
+		if got := w.Header().Get("ETag"); got != `"3"` {
+			t.Errorf("If-Match %s: ETag %s, want the current \"3\"", header, got)
+		}
+		var body struct {
+			Code    string                 `json:"code"`
+			Current map[string]interface{} `json:"current"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != string(errcode.VersionConflict) || body.Current["version"] != float64(3) {
+			t.Errorf("If-Match %s: body %s, want the conflict with the current row", header, w.Body)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+	"dormsystem/validation"
+)
+
+// feeScheduleBuilding is the building a schedule is confined to, or 0 for a
+// room type schedule that applies everywhere.
+func feeScheduleBuilding(fs models.FeeSchedule) (uint, error) {
+	if fs.BuildingID != nil {
+		return *fs.BuildingID, nil
+	}
+	if fs.RoomID != nil {
+		var r models.DormRoom
+		if err := db.DB.First(&r, *fs.RoomID).Error; err != nil {
+			return 0, err
+		}
+		return r.BuildingID, nil
+	}
+	return 0, nil
+}
+
+// requireFeeScheduleTarget checks that the schedule's building or room
+// exists and that the caller may change it.
+func requireFeeScheduleTarget(c *gin.Context, fs models.FeeSchedule) bool {
+	if fs.BuildingID != nil {
+		var b models.ApartmentBuilding
+		if err := db.DB.First(&b, *fs.BuildingID).Error; err != nil {
+			respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
+			return false
+		}
+	}
+	bid, err := feeScheduleBuilding(fs)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.RoomNotFound)
+		return false
+	}
+	if bid == 0 {
+		return true
+	}
+	return requireBuildings(c, bid)
+}
+
+func ListFeeSchedules(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
+	var list []models.FeeSchedule
+	query := db.DB.Model(&models.FeeSchedule{})
+	if !scope.all {
+		// Schedules of other buildings stay hidden; room type schedules
+		// without a building apply everywhere.
+		query = query.Where(
+			db.DB.Where("building_id in ?", scope.ids).
+				Or("room_id in (?)", scope.apply(db.DB.Model(&models.DormRoom{}), "building_id").Select("id")).
+				Or("building_id is null and room_id is null"),
+		)
+	}
+	termIDStr := c.Query("termID")
+	if termIDStr != "" {
+		if id, err := strconv.Atoi(termIDStr); err == nil && id > 0 {
+			query = query.Where("term_id = ?", id)
+		}
+	}
+	if feeType := c.Query("feeType"); feeType != "" {
+		query = query.Where("fee_type = ?", feeType)
+	}
+	buildingIDStr := c.Query("buildingID")
+	if buildingIDStr != "" {
+		if id, err := strconv.Atoi(buildingIDStr); err == nil && id > 0 {
+			query = query.Where("building_id = ?", id)
+		}
+	}
+	roomIDStr := c.Query("roomID")
+	if roomIDStr != "" {
+		if id, err := strconv.Atoi(roomIDStr); err == nil && id > 0 {
+			query = query.Where("room_id = ?", id)
+		}
+	}
+	if roomType := c.Query("roomType"); roomType != "" {
+		query = query.Where("room_type = ?", roomType)
+	}
+	if applyPagination(c, query.Order("term_id, fee_type, id"), &list) {
+		return
+	}
+}
+
+func CreateFeeSchedule(c *gin.Context) {
+	var fs models.FeeSchedule
+	if !bindJSON(c, &fs) {
+		return
+	}
+	fs.ID = 0
+	fs.Version = 1
+	if invalid(c, validation.FeeSchedule(fs)) {
+		return
+	}
+	if !requireFeeScheduleTarget(c, fs) {
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenTerm(tx, fs.TermID); err != nil {
+			return err
+		}
+		if err := tx.Create(&fs).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityFeeSchedule, fs.ID, nil, fs)
+	})
+	if respondTermError(c, err) {
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, fs)
+}
+
+func GetFeeSchedule(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var fs models.FeeSchedule
+	if err := db.DB.First(&fs, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	bid, err := feeScheduleBuilding(fs)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	if bid != 0 && !requireBuildings(c, bid) {
+		return
+	}
+	respondVersioned(c, fs.Version, fs)
+}
+
+// UpdateFeeSchedule changes a schedule. Bills already generated keep the
+// amount they were issued with. Schedules of closed terms cannot change.
+func UpdateFeeSchedule(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var fs models.FeeSchedule
+	if err := db.DB.First(&fs, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	var req models.FeeSchedule
+	if !bindJSON(c, &req) {
+		return
+	}
+	if invalid(c, validation.FeeSchedule(req)) {
+		return
+	}
+	if !requireFeeScheduleTarget(c, fs) || !requireFeeScheduleTarget(c, req) {
+		return
+	}
+	if !checkIfMatch(c, fs.Version, fs) {
+		return
+	}
+	before := fs
+	version := fs.Version
+	fs.Version++
+	fs.TermID = req.TermID
+	fs.FeeType = req.FeeType
+	fs.BuildingID = req.BuildingID
+	fs.RoomID = req.RoomID
+	fs.RoomType = req.RoomType
+	fs.Amount = req.Amount
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenTerm(tx, before.TermID); err != nil {
+			return err
+		}
+		if err := lockOpenTerm(tx, fs.TermID); err != nil {
+			return err
+		}
+		if err := saveVersioned(tx, &fs, version); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityFeeSchedule, fs.ID, before, fs)
+	})
+	if respondTermError(c, err) {
+		return
+	}
+	if errors.Is(err, errStaleVersion) {
+		var cur models.FeeSchedule
+		if err := db.DB.First(&cur, fs.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, fs.Version)
+	c.JSON(http.StatusOK, fs)
+}
+
+// DeleteFeeSchedule removes a schedule. Bills generated from it stay.
+func DeleteFeeSchedule(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var fs models.FeeSchedule
+	if err := db.DB.First(&fs, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireFeeScheduleTarget(c, fs) {
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenTerm(tx, fs.TermID); err != nil {
+			return err
+		}
+		if err := tx.Delete(&fs).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditDelete, entityFeeSchedule, fs.ID, fs, nil)
+	})
+	if respondTermError(c, err) {
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
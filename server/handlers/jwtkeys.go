@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"dormsystem/config"
+)
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// private signs tokens, public verifies them. For HS256 both are the
+	// shared secret and the key is never published.
+	private interface{}
+	public  interface{}
+}
+
+type keyRing struct {
+	active *signingKey
+	byKID  map[string]*signingKey
+}
+
+var jwtKeys *keyRing
+
+// InitSigningKeys loads the JWT keys once at startup. Every key in the ring
+// verifies tokens; only the active one signs new tokens.
+func InitSigningKeys(cfg config.Config) error {
+	ring, err := loadKeyRing(cfg)
+	if err != nil {
+		return err
+	}
+	jwtKeys = ring
+	return nil
+}
+
+func loadKeyRing(cfg config.Config) (*keyRing, error) {
+	ring := &keyRing{byKID: map[string]*signingKey{}}
+	switch cfg.JWTAlgorithm {
+	case "HS256":
+		secrets := append([]string{cfg.JWTSecret}, cfg.JWTPreviousSecrets...)
+		for i, secret := range secrets {
+			k := &signingKey{
+				kid:     hmacKID(secret),
+				method:  jwt.SigningMethodHS256,
+				private: []byte(secret),
+				public:  []byte(secret),
+			}
+			ring.byKID[k.kid] = k
+			if i == 0 {
+				ring.active = k
+			}
+		}
+	case "RS256", "EdDSA":
+		if cfg.JWTKeyDir == "" {
+			return nil, fmt.Errorf("DORM_JWT_KEY_DIR is required for %s", cfg.JWTAlgorithm)
+		}
+		files, err := filepath.Glob(filepath.Join(cfg.JWTKeyDir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			k, err := loadPEMKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if k.method.Alg() != cfg.JWTAlgorithm {
+				return nil, fmt.Errorf("%s: key is %s, expected %s", file, k.method.Alg(), cfg.JWTAlgorithm)
+			}
+			ring.byKID[k.kid] = k
+			// Without an explicit choice the last file by name signs, so
+			// date-prefixed names rotate naturally.
+			if cfg.JWTActiveKID == "" || cfg.JWTActiveKID == k.kid {
+				ring.active = k
+			}
+		}
+		if len(ring.byKID) == 0 {
+			return nil, fmt.Errorf("no *.pem keys in %s", cfg.JWTKeyDir)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.JWTAlgorithm)
+	}
+	if ring.active == nil {
+		return nil, fmt.Errorf("active key %q not found", cfg.JWTActiveKID)
+	}
+	return ring, nil
+}
+
+// hmacKID derives a stable kid that does not reveal the secret.
+func hmacKID(secret string) string {
+	sum := sha256.Sum256([]byte("kid:" + secret))
+	return "hs-" + hex.EncodeToString(sum[:6])
+}
+
+// loadPEMKey reads a PKCS#8 (RSA or Ed25519) or PKCS#1 (RSA) private key.
+// The file name without extension is the kid.
+func loadPEMKey(file string) (*signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	var parsed interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: key, public: key.Public()}, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+func signClaims(claims jwt.Claims) (string, error) {
+	if jwtKeys == nil {
+		return "", errors.New("signing keys not initialised")
+	}
+	token := jwt.NewWithClaims(jwtKeys.active.method, claims)
+	token.Header["kid"] = jwtKeys.active.kid
+	return token.SignedString(jwtKeys.active.private)
+}
+
+// parseClaims verifies tokenStr against the key named by its kid and rejects
+// any algorithm other than that key's own.
+func parseClaims(tokenStr string, claims jwt.Claims) error {
+	if jwtKeys == nil {
+		return errors.New("signing keys not initialised")
+	}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := jwtKeys.byKID[kid]
+		if !ok {
+			return nil, errors.New("unknown kid")
+		}
+		if t.Method.Alg() != k.method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.public, nil
+	}, jwt.WithValidMethods([]string{jwtKeys.active.method.Alg()}), jwt.WithExpirationRequired())
+	return err
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// GetJWKS publishes the public halves of the asymmetric keys. HS256 secrets
+// are never listed.
+func GetJWKS(c *gin.Context) {
+	keys := []JWK{}
+	if jwtKeys != nil {
+		kids := make([]string, 0, len(jwtKeys.byKID))
+		for kid := range jwtKeys.byKID {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		for _, kid := range kids {
+			if jwk, ok := publicJWK(jwtKeys.byKID[kid]); ok {
+				keys = append(keys, jwk)
+			}
+		}
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func publicJWK(k *signingKey) (JWK, bool) {
+	enc := base64.RawURLEncoding
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.kid,
+			Use: "sig",
+			Alg: k.method.Alg(),
+			N:   enc.EncodeToString(pub.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: k.kid,
+			Use: "sig",
+			Alg: k.method.Alg(),
+			Crv: "Ed25519",
+			X:   enc.EncodeToString(pub),
+		}, true
+	}
+	return JWK{}, false
+}
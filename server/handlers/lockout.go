@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+// recordLoginFailure counts a failed password for u and locks the account
+// once the configured limit is reached.
+func recordLoginFailure(c *gin.Context, u models.User) {
+	var count int
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", u.ID).
+			Update("failed_login_count", gorm.Expr("failed_login_count + 1")).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", u.ID).
+			Pluck("failed_login_count", &count).Error; err != nil {
+			return err
+		}
+		if count < settings.MaxLoginAttempts {
+			return nil
+		}
+		return tx.Model(&models.User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+			"failed_login_count": 0,
+			"locked_until":       time.Now().Add(settings.LockoutDuration),
+		}).Error
+	})
+	if err != nil {
+		log.Println("record login failure error", err)
+		return
+	}
+	log.Printf("failed login for %q from %s (%d/%d)", u.Username, c.ClientIP(), count, settings.MaxLoginAttempts)
+	if count >= settings.MaxLoginAttempts {
+		log.Printf("account %q locked for %s after %d failed logins, last from %s",
+			u.Username, settings.LockoutDuration, count, c.ClientIP())
+	}
+}
+
+func UnlockUser(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	before := u
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&u).Updates(map[string]interface{}{"failed_login_count": 0, "locked_until": nil}).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, u)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	me, _ := currentUser(c)
+	log.Printf("account %q unlocked by %q", u.Username, me.Username)
+	c.JSON(http.StatusOK, u)
+}
+
+// ipLimiter is a fixed-window request counter per client IP.
+type ipLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*ipWindow
+}
+
+type ipWindow struct {
+	start time.Time
+	count int
+}
+
+func (l *ipLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.entries[ip]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.entries[ip] = &ipWindow{start: now, count: 1}
+		return true
+	}
+	w.count++
+	return w.count <= l.limit
+}
+
+func (l *ipLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, w := range l.entries {
+		if now.Sub(w.start) >= l.window {
+			delete(l.entries, ip)
+		}
+	}
+}
+
+// LoginRateLimit caps the number of login requests per client IP.
+func LoginRateLimit() gin.HandlerFunc {
+	l := &ipLimiter{
+		limit:   settings.LoginRateLimit,
+		window:  time.Minute,
+		entries: map[string]*ipWindow{},
+	}
+	go func() {
+		for now := range time.Tick(l.window) {
+			l.sweep(now)
+		}
+	}()
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if !l.allow(ip, time.Now()) {
+			log.Printf("login rate limit exceeded for %s", ip)
+			c.Header("Retry-After", strconv.Itoa(int(l.window.Seconds())))
+			abortError(c, http.StatusTooManyRequests, errcode.TooManyLoginAttempts)
+			return
+		}
+		c.Next()
+	}
+}
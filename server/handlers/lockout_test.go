@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func newIPLimiter(limit int) *ipLimiter {
+	return &ipLimiter{limit: limit, window: time.Minute, entries: map[string]*ipWindow{}}
+}
+
+func TestIPLimiterWindow(t *testing.T) {
+	l := newIPLimiter(3)
+	start := time.Date(2025, 10, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if !l.allow("203.0.113.5", start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("request %d was refused within the limit", i+1)
+		}
+	}
+	if l.allow("203.0.113.5", start.Add(59*time.Second)) {
+		t.Error("a fourth request in the same window was allowed")
+	}
+	if !l.allow("198.51.100.7", start.Add(59*time.Second)) {
+		t.Error("another IP was refused because of the first one")
+	}
+	if !l.allow("203.0.113.5", start.Add(time.Minute)) {
+		t.Error("the next window still refuses the IP")
+	}
+	if !l.allow("203.0.113.5", start.Add(time.Minute+time.Second)) {
+		t.Error("the count was not reset with the window")
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	l := newIPLimiter(1)
+	start := time.Date(2025, 10, 1, 8, 0, 0, 0, time.UTC)
+	l.allow("203.0.113.5", start)
+	l.allow("198.51.100.7", start.Add(30*time.Second))
+	l.sweep(start.Add(time.Minute))
+	if _, ok := l.entries["203.0.113.5"]; ok {
+		t.Error("an expired window was kept")
+	}
+	if _, ok := l.entries["198.51.100.7"]; !ok {
+		t.Error("a current window was swept")
+	}
+	if l.allow("198.51.100.7", start.Add(time.Minute)) {
+		t.Error("sweeping reset a current window")
+	}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+	"dormsystem/validation"
+)
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type ProfileRequest struct {
+	Name string `json:"name"`
+}
+
+func GetMe(c *gin.Context) {
+	me, _ := currentUser(c)
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	respondVersioned(c, u.Version, u)
+}
+
+// UpdateMe lets a user edit their own profile. Username and role stay
+// admin-managed.
+func UpdateMe(c *gin.Context) {
+	me, _ := currentUser(c)
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	var req ProfileRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var errs validation.Errors
+	validation.Required(&errs, "name", req.Name)
+	if invalid(c, errs) {
+		return
+	}
+	if !checkIfMatch(c, u.Version, u) {
+		return
+	}
+	before := u
+	version := u.Version
+	u.Version++
+	u.Name = req.Name
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &u, version, "name"); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, u)
+	})
+	if errors.Is(err, errStaleVersion) {
+		respondStaleUser(c, u.ID)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, u.Version)
+	c.JSON(http.StatusOK, u)
+}
+
+func ChangePassword(c *gin.Context) {
+	me, _ := currentUser(c)
+	var req ChangePasswordRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusUnauthorized, errcode.UserNotFound)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.OldPassword)); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.WrongOldPassword)
+		return
+	}
+	if req.NewPassword == req.OldPassword {
+		respondError(c, http.StatusBadRequest, errcode.PasswordUnchanged)
+		return
+	}
+	if perr := checkPasswordPolicy(u.Username, req.NewPassword); perr != nil {
+		respondError(c, http.StatusBadRequest, perr.Code, perr.Args...)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.PasswordHashFailed)
+		return
+	}
+	before := u
+	u.PasswordHash = string(hash)
+	u.MustChangePassword = false
+	var resp LoginResponse
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the password columns, so a concurrent account edit is kept.
+		if err := tx.Model(&u).Select("password_hash", "must_change_password").Updates(&u).Error; err != nil {
+			return err
+		}
+		// Sessions opened with the old password must not survive the change.
+		if err := revokeUserSessions(tx, u.ID); err != nil {
+			return err
+		}
+		// The hash is left out of user snapshots.
+		if err := writeAudit(tx, c, auditPassword, entityUser, u.ID, before, u); err != nil {
+			return err
+		}
+		resp, err = issueSession(tx, u)
+		return err
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
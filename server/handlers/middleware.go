@@ -5,32 +5,92 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 
-	"dormsystem/config"
+	"dormsystem/errcode"
 )
 
+const ctxAuthUser = "authUser"
+
+// AuthUser is the caller identity taken from a verified token.
+type AuthUser struct {
+	ID       uint
+	Username string
+	Role     string
+	// TokenID is the jti of the access token used for this request.
+	TokenID string
+	// MustChangePassword is set for accounts that still use a bootstrap
+	// password; RequirePermission rejects them until it is changed.
+	MustChangePassword bool
+	// MustEnrollTOTP is set for roles that require 2FA until it is enabled.
+	MustEnrollTOTP bool
+	// APIKeyID and Scopes are set when the caller used an API key. The key
+	// only grants permissions that are both in Scopes and in the role.
+	APIKeyID uint
+	Scopes   []string
+}
+
+func currentUser(c *gin.Context) (AuthUser, bool) {
+	v, ok := c.Get(ctxAuthUser)
+	if !ok {
+		return AuthUser{}, false
+	}
+	u, ok := v.(AuthUser)
+	return u, ok
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "缺少令牌"})
+			abortError(c, http.StatusUnauthorized, errcode.TokenMissing)
 			return
 		}
 		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "令牌格式错误"})
+		if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "ApiKey") {
+			abortError(c, http.StatusUnauthorized, errcode.MalformedToken)
 			return
 		}
-		cfg := config.Load()
-		token, err := jwt.Parse(parts[1], func(t *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "令牌无效"})
+		var u AuthUser
+		var code errcode.Code
+		if parts[0] == "ApiKey" {
+			u, code = authenticateAPIKey(parts[1])
+		} else {
+			u, code = authenticateJWT(parts[1])
+		}
+		if code != "" {
+			abortError(c, http.StatusUnauthorized, code)
 			return
 		}
+		c.Set(ctxAuthUser, u)
 		c.Next()
 	}
 }
 
+func authenticateJWT(tokenStr string) (AuthUser, errcode.Code) {
+	var claims AuthClaims
+	if err := parseClaims(tokenStr, &claims); err != nil || claims.UserID == 0 {
+		return AuthUser{}, errcode.InvalidToken
+	}
+	if isTokenRevoked(claims.ID) {
+		return AuthUser{}, errcode.TokenRevoked
+	}
+	return AuthUser{
+		ID:                 claims.UserID,
+		Username:           claims.Username,
+		Role:               claims.Role,
+		TokenID:            claims.ID,
+		MustChangePassword: claims.MustChangePassword,
+		MustEnrollTOTP:     claims.MustEnrollTOTP,
+	}, ""
+}
+
+// RejectAPIKeys keeps API keys away from routes meant for interactive users.
+func RejectAPIKeys() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if u, ok := currentUser(c); ok && u.APIKeyID != 0 {
+			abortError(c, http.StatusForbidden, errcode.APIKeyForbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"dormsystem/errcode"
+)
+
+// checkPasswordPolicy returns why password is not acceptable for username,
+// or nil when it is.
+func checkPasswordPolicy(username, password string) *errcode.Error {
+	if len([]rune(password)) < settings.PasswordMinLength {
+		return errcode.New(errcode.PasswordTooShort, settings.PasswordMinLength)
+	}
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < settings.PasswordMinClasses {
+		return errcode.New(errcode.PasswordTooSimple, settings.PasswordMinClasses)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errcode.New(errcode.PasswordContainsUsername)
+	}
+	return nil
+}
@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
+	"dormsystem/validation"
 )
 
 type PaymentRequest struct {
@@ -19,11 +24,25 @@ type PaymentRequest struct {
 	PaidAt      string  `json:"paidAt"`
 	PaymentType string  `json:"paymentType"`
 	Amount      float64 `json:"amount"`
+	// BillID is the bill the payment settles; BuildingID and RoomID then
+	// default to the bill's. Without it the payment goes to the student's
+	// oldest open bill of the same type that it fits in.
+	BillID *uint `json:"billID"`
+	// TermID defaults to the bill's term, or else the term PaidAt falls in.
+	TermID *uint `json:"termID"`
 }
 
+// errBillOverpaid is returned when a payment is larger than what is still
+// owed on its bill.
+var errBillOverpaid = errors.New("bill overpaid")
+
 func ListPayments(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
 	var list []models.Payment
-	query := db.DB.Model(&models.Payment{})
+	query := scope.apply(db.DB.Model(&models.Payment{}), "building_id")
 	keyword := c.Query("keyword")
 	if keyword != "" {
 		query = query.Where(
@@ -50,6 +69,22 @@ func ListPayments(c *gin.Context) {
 			query = query.Where("student_id = ?", id)
 		}
 	}
+	billIDStr := c.Query("billID")
+	if billIDStr != "" {
+		if id, err := strconv.Atoi(billIDStr); err == nil && id > 0 {
+			query = query.Where("bill_id = ?", id)
+		}
+	}
+	termIDStr := c.Query("termID")
+	if termIDStr != "" {
+		if id, err := strconv.Atoi(termIDStr); err == nil && id > 0 {
+			query = query.Where("term_id = ?", id)
+		}
+	}
+	status := c.Query("status")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
 	if applyPagination(c, query, &list) {
 		return
 	}
@@ -57,45 +92,86 @@ func ListPayments(c *gin.Context) {
 
 func CreatePayment(c *gin.Context) {
 	var req PaymentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
-	if req.BuildingID == 0 || req.RoomID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓号和寝室号不能为空"})
+	if invalid(c, validation.Payment(req.PaymentNo, req.PaymentType, req.Amount)) {
 		return
 	}
-	var b models.ApartmentBuilding
-	if err := db.DB.First(&b, req.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓不存在"})
-		return
+	var bill *models.Bill
+	if req.BillID != nil {
+		var b models.Bill
+		if err := db.DB.First(&b, *req.BillID).Error; err != nil {
+			respondError(c, http.StatusBadRequest, errcode.BillNotFound)
+			return
+		}
+		// A payment against a bill goes to the bill's room and building,
+		// wherever the student or the room is now.
+		if req.BuildingID == 0 && req.RoomID == 0 {
+			req.BuildingID, req.RoomID = b.BuildingID, b.RoomID
+		}
+		if req.StudentID == 0 {
+			req.StudentID = b.StudentID
+		}
+		if b.StudentID != req.StudentID || b.FeeType != req.PaymentType ||
+			b.BuildingID != req.BuildingID || b.RoomID != req.RoomID {
+			respondError(c, http.StatusBadRequest, errcode.PaymentBillMismatch)
+			return
+		}
+		if req.TermID != nil && *req.TermID != b.TermID {
+			respondError(c, http.StatusBadRequest, errcode.PaymentTermMismatch)
+			return
+		}
+		bill = &b
 	}
-	var r models.DormRoom
-	if err := db.DB.First(&r, req.RoomID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不存在"})
+	if req.BuildingID == 0 || req.RoomID == 0 {
+		respondError(c, http.StatusBadRequest, errcode.BuildingAndRoomRequired)
 		return
 	}
-	if r.BuildingID != req.BuildingID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不属于该公寓"})
+	if !requireBuildings(c, req.BuildingID) {
 		return
 	}
-	if req.StudentID != 0 {
-		var s models.Student
-		if err := db.DB.First(&s, req.StudentID).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "学生不存在"})
+	if bill == nil {
+		var b models.ApartmentBuilding
+		if err := db.DB.First(&b, req.BuildingID).Error; err != nil {
+			respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
+			return
+		}
+		var r models.DormRoom
+		if err := db.DB.First(&r, req.RoomID).Error; err != nil {
+			respondError(c, http.StatusBadRequest, errcode.RoomNotFound)
 			return
 		}
-		if s.RoomID != req.RoomID || s.BuildingID != req.BuildingID {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "学生不在指定公寓寝室中"})
+		if r.BuildingID != req.BuildingID {
+			respondError(c, http.StatusBadRequest, errcode.RoomNotInBuilding)
 			return
 		}
+		if req.TermID != nil {
+			var t models.Term
+			if err := db.DB.First(&t, *req.TermID).Error; err != nil {
+				respondError(c, http.StatusBadRequest, errcode.TermNotFound)
+				return
+			}
+		}
+		if req.StudentID != 0 {
+			// Checked-out students may still settle what they owe.
+			var s models.Student
+			if err := db.DB.Unscoped().First(&s, req.StudentID).Error; err != nil {
+				respondError(c, http.StatusBadRequest, errcode.StudentNotFound)
+				return
+			}
+			if s.RoomID != req.RoomID || s.BuildingID != req.BuildingID {
+				respondError(c, http.StatusBadRequest, errcode.StudentNotInRoom)
+				return
+			}
+		}
 	}
 	paidAt, err := time.Parse("2006-01-02", req.PaidAt)
 	if err != nil {
 		paidAt, err = time.Parse(time.RFC3339, req.PaidAt)
 	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "交费日期格式应为YYYY-MM-DD"})
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "paidAt"})
 		return
 	}
 	p := models.Payment{
@@ -106,92 +182,241 @@ func CreatePayment(c *gin.Context) {
 		PaidAt:      paidAt,
 		PaymentType: req.PaymentType,
 		Amount:      req.Amount,
+		Status:      models.PaymentPosted,
+		TermID:      req.TermID,
+		Version:     1,
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if bill == nil && p.StudentID != 0 {
+			var open models.Bill
+			query := tx.Table("v_bills").
+				Where("student_id = ? and fee_type = ? and due_amount - paid_amount >= ?", p.StudentID, p.PaymentType, p.Amount)
+			if p.TermID != nil {
+				query = query.Where("term_id = ?", *p.TermID)
+			}
+			err := query.Order("id").First(&open).Error
+			if err == nil {
+				bill = &open
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		if bill != nil {
+			if err := settleBill(tx, &p, bill.ID); err != nil {
+				return err
+			}
+			p.TermID = &bill.TermID
+		} else if p.TermID == nil {
+			termID, err := termOn(tx, p.PaidAt)
+			if err != nil {
+				return err
+			}
+			p.TermID = termID
+		}
+		if err := tx.Create(&p).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityPayment, p.ID, nil, p)
+	})
+	if errors.Is(err, errBillOverpaid) {
+		respondError(c, http.StatusConflict, errcode.PaymentExceedsBill)
+		return
 	}
-	if err := db.DB.Create(&p).Error; err != nil {
-		respondDBError(c, err, "创建失败")
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
 		return
 	}
 	c.JSON(http.StatusOK, p)
 }
 
-func UpdatePayment(c *gin.Context) {
+// settleBill points p at the bill, locking it so that concurrent payments
+// cannot together pay more than is owed after adjustments.
+func settleBill(tx *gorm.DB, p *models.Payment, billID uint) error {
+	if err := tx.Exec("select id from bills where id = ? for update", billID).Error; err != nil {
+		return err
+	}
+	var b models.Bill
+	if err := billsView(tx).Where("id = ?", billID).First(&b).Error; err != nil {
+		return err
+	}
+	// Amounts are in yuan; allow for float rounding below a fen.
+	if p.Amount > b.DueAmount-b.PaidAmount+0.005 {
+		return errBillOverpaid
+	}
+	p.BillID = &billID
+	return nil
+}
+
+func GetPayment(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
 		return
 	}
 	var p models.Payment
 	if err := db.DB.First(&p, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		respondError(c, http.StatusNotFound, errcode.NotFound)
 		return
 	}
-	var req PaymentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !requireBuildings(c, p.BuildingID) {
 		return
 	}
-	if req.BuildingID == 0 || req.RoomID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓号和寝室号不能为空"})
+	respondVersioned(c, p.Version, p)
+}
+
+type PaymentCorrectionRequest struct {
+	Reason string `json:"reason"`
+	// PaymentNo and PaidAt are only read when posting a reversal. They
+	// default to the original number with an "-R" suffix and today.
+	PaymentNo string `json:"paymentNo"`
+	PaidAt    string `json:"paidAt"`
+}
+
+// loadPostedPayment reads the payment named by :id and the correction
+// request, and checks that the payment can still be corrected.
+func loadPostedPayment(c *gin.Context, p *models.Payment, req *PaymentCorrectionRequest) bool {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return false
+	}
+	if err := db.DB.First(p, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return false
+	}
+	if !requireBuildings(c, p.BuildingID) {
+		return false
+	}
+	if !bindJSON(c, req) {
+		return false
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		respondError(c, http.StatusBadRequest, errcode.ReasonRequired)
+		return false
+	}
+	if p.ReversalOfID != nil {
+		respondError(c, http.StatusConflict, errcode.ReversalNotCorrectable)
+		return false
+	}
+	if p.Status != models.PaymentPosted {
+		respondError(c, http.StatusConflict, errcode.PaymentAlreadyCorrected)
+		return false
+	}
+	return true
+}
+
+// markCorrected moves a posted payment to status inside tx, failing with
+// errStaleVersion if another request corrected it first.
+func markCorrected(tx *gorm.DB, p *models.Payment, status string) error {
+	res := tx.Model(p).Where("status = ?", models.PaymentPosted).Updates(map[string]interface{}{
+		"status":    status,
+		"reason":    p.Reason,
+		"voided_at": p.VoidedAt,
+		"version":   gorm.Expr("version + 1"),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStaleVersion
+	}
+	p.Version++
+	return nil
+}
+
+// VoidPayment cancels a posted payment. The row stays for the audit trail
+// but no longer counts towards any total.
+func VoidPayment(c *gin.Context) {
+	var p models.Payment
+	var req PaymentCorrectionRequest
+	if !loadPostedPayment(c, &p, &req) {
 		return
 	}
-	var b models.ApartmentBuilding
-	if err := db.DB.First(&b, req.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓不存在"})
+	before := p
+	now := time.Now()
+	p.Status = models.PaymentVoided
+	p.Reason = req.Reason
+	p.VoidedAt = &now
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := markCorrected(tx, &p, models.PaymentVoided); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditVoid, entityPayment, p.ID, before, p)
+	})
+	if errors.Is(err, errStaleVersion) {
+		respondError(c, http.StatusConflict, errcode.PaymentAlreadyCorrected)
 		return
 	}
-	var r models.DormRoom
-	if err := db.DB.First(&r, req.RoomID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不存在"})
+	if err != nil {
+		respondDBError(c, err, errcode.VoidFailed)
 		return
 	}
-	if r.BuildingID != req.BuildingID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不属于该公寓"})
+	c.JSON(http.StatusOK, p)
+}
+
+// ReversePayment posts a negative entry that cancels a posted payment and
+// links back to it.
+func ReversePayment(c *gin.Context) {
+	var p models.Payment
+	var req PaymentCorrectionRequest
+	if !loadPostedPayment(c, &p, &req) {
 		return
 	}
-	if req.StudentID != 0 {
-		var s models.Student
-		if err := db.DB.First(&s, req.StudentID).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "学生不存在"})
-			return
+	paidAt := time.Now()
+	if req.PaidAt != "" {
+		var err error
+		paidAt, err = time.Parse("2006-01-02", req.PaidAt)
+		if err != nil {
+			paidAt, err = time.Parse(time.RFC3339, req.PaidAt)
 		}
-		if s.RoomID != req.RoomID || s.BuildingID != req.BuildingID {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "学生不在指定公寓寝室中"})
+		if err != nil {
+			respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "paidAt"})
 			return
 		}
 	}
-	paidAt, err := time.Parse("2006-01-02", req.PaidAt)
-	if err != nil {
-		paidAt, err = time.Parse(time.RFC3339, req.PaidAt)
+	if req.PaymentNo == "" {
+		req.PaymentNo = p.PaymentNo + "-R"
 	}
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "交费日期格式应为YYYY-MM-DD"})
-		return
+	before := p
+	p.Status = models.PaymentReversed
+	p.Reason = req.Reason
+	reversal := models.Payment{
+		PaymentNo:    req.PaymentNo,
+		BuildingID:   p.BuildingID,
+		RoomID:       p.RoomID,
+		StudentID:    p.StudentID,
+		PaidAt:       paidAt,
+		PaymentType:  p.PaymentType,
+		Amount:       -p.Amount,
+		Status:       models.PaymentPosted,
+		Reason:       req.Reason,
+		ReversalOfID: &p.ID,
+		BillID:       p.BillID,
+		TermID:       p.TermID,
+		Version:      1,
 	}
-	p.PaymentNo = req.PaymentNo
-	p.BuildingID = req.BuildingID
-	p.RoomID = req.RoomID
-	p.StudentID = req.StudentID
-	p.PaidAt = paidAt
-	p.PaymentType = req.PaymentType
-	p.Amount = req.Amount
-	if err := db.DB.Save(&p).Error; err != nil {
-		respondDBError(c, err, "更新失败")
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := markCorrected(tx, &p, models.PaymentReversed); err != nil {
+			return err
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditReverse, entityPayment, p.ID, before, p); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityPayment, reversal.ID, nil, reversal)
+	})
+	if errors.Is(err, errStaleVersion) {
+		respondError(c, http.StatusConflict, errcode.PaymentAlreadyCorrected)
 		return
 	}
-	c.JSON(http.StatusOK, p)
-}
-
-func DeletePayment(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
-		return
-	}
-	if err := db.DB.Delete(&models.Payment{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+		respondDBError(c, err, errcode.ReverseFailed)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, reversal)
 }
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"dormsystem/errcode"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleManager  = "manager"
+	RoleFinance  = "finance"
+	RoleReadOnly = "readonly"
+)
+
+const (
+	PermBuildingsRead  = "buildings:read"
+	PermBuildingsWrite = "buildings:write"
+	PermRoomsRead      = "rooms:read"
+	PermRoomsWrite     = "rooms:write"
+	PermStudentsRead   = "students:read"
+	PermStudentsWrite  = "students:write"
+	PermPaymentsRead   = "payments:read"
+	PermPaymentsWrite  = "payments:write"
+	PermUsersRead      = "users:read"
+	PermUsersWrite     = "users:write"
+	PermStatsRead      = "stats:read"
+	PermAuditRead      = "audit:read"
+	PermTermsRead      = "terms:read"
+	PermTermsWrite     = "terms:write"
+	PermTrashRead      = "trash:read"
+)
+
+// rolePermissions is the permission matrix. Admins are allowed everything
+// and are therefore not listed here; PermTrashRead is theirs alone.
+var rolePermissions = map[string][]string{
+	RoleManager: {
+		PermBuildingsRead,
+		PermRoomsRead, PermRoomsWrite,
+		PermStudentsRead, PermStudentsWrite,
+		PermPaymentsRead,
+		PermStatsRead,
+		PermTermsRead,
+	},
+	RoleFinance: {
+		PermBuildingsRead,
+		PermRoomsRead,
+		PermStudentsRead,
+		PermPaymentsRead, PermPaymentsWrite,
+		PermStatsRead,
+		PermTermsRead,
+	},
+	RoleReadOnly: {
+		PermBuildingsRead,
+		PermRoomsRead,
+		PermStudentsRead,
+		PermPaymentsRead,
+		PermStatsRead,
+		PermTermsRead,
+	},
+}
+
+var allPermissions = []string{
+	PermBuildingsRead, PermBuildingsWrite,
+	PermRoomsRead, PermRoomsWrite,
+	PermStudentsRead, PermStudentsWrite,
+	PermPaymentsRead, PermPaymentsWrite,
+	PermUsersRead, PermUsersWrite,
+	PermStatsRead,
+	PermAuditRead,
+	PermTermsRead, PermTermsWrite,
+	PermTrashRead,
+}
+
+func IsKnownPermission(perm string) bool {
+	return containsString(allPermissions, perm)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func IsKnownRole(role string) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func HasPermission(role, perm string) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	return containsString(rolePermissions[role], perm)
+}
+
+// granted reports whether u's role has perm and, for an API key, whether the
+// key was given it.
+func granted(u AuthUser, perm string) bool {
+	return HasPermission(u.Role, perm) && (u.APIKeyID == 0 || containsString(u.Scopes, perm))
+}
+
+// RequirePermission must run after AuthMiddleware.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c)
+		if !ok {
+			abortError(c, http.StatusUnauthorized, errcode.Unauthenticated)
+			return
+		}
+		if u.MustChangePassword {
+			abortError(c, http.StatusForbidden, errcode.PasswordChangeRequired)
+			return
+		}
+		if u.MustEnrollTOTP {
+			abortError(c, http.StatusForbidden, errcode.TOTPEnrollmentRequired)
+			return
+		}
+		if !granted(u, perm) {
+			abortError(c, http.StatusForbidden, errcode.Forbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveAs runs RequirePermission(perm) for a request made as u, or without
+// a caller when u is nil, and returns the status. A request that gets past
+// it is answered 204.
+func serveAs(u *AuthUser, perm string) int {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		if u != nil {
+			c.Set(ctxAuthUser, *u)
+		}
+	}, RequirePermission(perm), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Code
+}
+
+func TestHasPermission(t *testing.T) {
+	want := map[string][]string{
+		RoleManager: {
+			PermBuildingsRead, PermRoomsRead, PermRoomsWrite, PermStudentsRead, PermStudentsWrite,
+			PermPaymentsRead, PermStatsRead, PermTermsRead,
+		},
+		RoleFinance: {
+			PermBuildingsRead, PermRoomsRead, PermStudentsRead, PermPaymentsRead, PermPaymentsWrite,
+			PermStatsRead, PermTermsRead,
+		},
+		RoleReadOnly: {
+			PermBuildingsRead, PermRoomsRead, PermStudentsRead, PermPaymentsRead, PermStatsRead, PermTermsRead,
+		},
+	}
+	for _, perm := range allPermissions {
+		if !HasPermission(RoleAdmin, perm) {
+			t.Errorf("admin lacks %s", perm)
+		}
+		for role, perms := range want {
+			if got := HasPermission(role, perm); got != containsString(perms, perm) {
+				t.Errorf("HasPermission(%s, %s) = %v", role, perm, got)
+			}
+		}
+	}
+	if HasPermission("guest", PermBuildingsRead) {
+		t.Error("an unknown role has a permission")
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name string
+		u    *AuthUser
+		perm string
+		want int
+	}{
+		{"no caller", nil, PermBuildingsRead, http.StatusUnauthorized},
+		{"admin", &AuthUser{Role: RoleAdmin}, PermUsersWrite, http.StatusNoContent},
+		{"manager allowed", &AuthUser{Role: RoleManager}, PermStudentsWrite, http.StatusNoContent},
+		{"manager denied", &AuthUser{Role: RoleManager}, PermPaymentsWrite, http.StatusForbidden},
+		{"finance allowed", &AuthUser{Role: RoleFinance}, PermPaymentsWrite, http.StatusNoContent},
+		{"finance denied", &AuthUser{Role: RoleFinance}, PermStudentsWrite, http.StatusForbidden},
+		{"readonly allowed", &AuthUser{Role: RoleReadOnly}, PermStatsRead, http.StatusNoContent},
+		{"readonly denied", &AuthUser{Role: RoleReadOnly}, PermRoomsWrite, http.StatusForbidden},
+		{"password change pending", &AuthUser{Role: RoleAdmin, MustChangePassword: true}, PermBuildingsRead, http.StatusForbidden},
+		{"2FA enrolment pending", &AuthUser{Role: RoleAdmin, MustEnrollTOTP: true}, PermBuildingsRead, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := serveAs(tt.u, tt.perm); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	key := func(role string, scopes ...string) *AuthUser {
+		return &AuthUser{Role: role, APIKeyID: 1, Scopes: scopes}
+	}
+	tests := []struct {
+		name string
+		u    *AuthUser
+		perm string
+		want int
+	}{
+		{"scope granted", key(RoleFinance, PermPaymentsRead, PermPaymentsWrite), PermPaymentsWrite, http.StatusNoContent},
+		{"scope not granted", key(RoleFinance, PermPaymentsRead), PermPaymentsWrite, http.StatusForbidden},
+		{"admin key limited to its scopes", key(RoleAdmin, PermStatsRead), PermUsersWrite, http.StatusForbidden},
+		{"scope beyond the role", key(RoleReadOnly, PermPaymentsWrite), PermPaymentsWrite, http.StatusForbidden},
+		{"no scopes", key(RoleAdmin), PermBuildingsRead, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := serveAs(tt.u, tt.perm); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRejectAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		name string
+		u    AuthUser
+		want int
+	}{
+		{"user", AuthUser{Role: RoleAdmin}, http.StatusNoContent},
+		{"API key", AuthUser{Role: RoleAdmin, APIKeyID: 1, Scopes: allPermissions}, http.StatusForbidden},
+	} {
+		r := gin.New()
+		r.GET("/", func(c *gin.Context) { c.Set(ctxAuthUser, tt.u) }, RejectAPIKeys(), func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTrashNeedsScope(t *testing.T) {
+	if granted(AuthUser{Role: RoleAdmin, APIKeyID: 1, Scopes: []string{PermStudentsRead}}, PermTrashRead) {
+		t.Error("an admin key without trash:read may list deleted rows")
+	}
+	if !granted(AuthUser{Role: RoleAdmin, APIKeyID: 1, Scopes: []string{PermTrashRead}}, PermTrashRead) {
+		t.Error("an admin key with trash:read may not list deleted rows")
+	}
+	if granted(AuthUser{Role: RoleManager}, PermTrashRead) {
+		t.Error("a manager may list deleted rows")
+	}
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/?includeDeleted=true", nil)
+	c.Set(ctxAuthUser, AuthUser{Role: RoleAdmin, APIKeyID: 1, Scopes: []string{PermStudentsRead}})
+	if _, ok := applyDeletedFilter(c, nil, "deleted_at"); ok || w.Code != http.StatusForbidden {
+		t.Errorf("includeDeleted without the scope: ok %v, status %d", ok, w.Code)
+	}
+}
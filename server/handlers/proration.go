@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/config"
+	"dormsystem/models"
+)
+
+// stayKey is one student in one room.
+type stayKey struct {
+	studentID uint
+	roomID    uint
+}
+
+// roundFen rounds an amount in yuan to the fen.
+func roundFen(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// billingPeriods splits a term into the periods accommodation is charged
+// by. Each period runs up to but not including its end; the first and last
+// ones may be cut short by the term's dates.
+func billingPeriods(t models.Term, unit string) [][2]time.Time {
+	end := t.EndDate.AddDate(0, 0, 1)
+	var periods [][2]time.Time
+	for start := t.StartDate; start.Before(end); {
+		y, m, d := start.Date()
+		next := start.AddDate(0, 0, 1)
+		switch unit {
+		case config.ProrateHalfMonth:
+			if d < 16 {
+				next = time.Date(y, m, 16, 0, 0, 0, 0, start.Location())
+			} else {
+				next = time.Date(y, m+1, 1, 0, 0, 0, 0, start.Location())
+			}
+		case config.ProrateMonthly:
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, start.Location())
+		}
+		if next.After(end) {
+			next = end
+		}
+		periods = append(periods, [2]time.Time{start, next})
+		start = next
+	}
+	return periods
+}
+
+// stayDays is how many days of period p the stay covers.
+func stayDays(p [2]time.Time, s models.StudentStay) int {
+	start, end := p[0], p[1]
+	if s.StartDate.After(start) {
+		start = s.StartDate
+	}
+	if s.EndDate != nil && s.EndDate.Before(end) {
+		end = *s.EndDate
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return int(end.Sub(start).Hours() / 24)
+}
+
+// chargedPeriods charges every period of the term in full to the room the
+// student spent most of it in, the later room on a tie, so that a transfer
+// never charges a period twice. stays must be ordered by student and start.
+// It returns the periods charged per student and room and the number of
+// periods in the term.
+func chargedPeriods(t models.Term, unit string, stays []models.StudentStay) (map[stayKey]int, int) {
+	periods := billingPeriods(t, unit)
+	charged := map[stayKey]int{}
+	for i := 0; i < len(stays); {
+		j := i
+		for j < len(stays) && stays[j].StudentID == stays[i].StudentID {
+			j++
+		}
+		for _, p := range periods {
+			best, bestDays := -1, 0
+			for k := i; k < j; k++ {
+				if d := stayDays(p, stays[k]); d > 0 && d >= bestDays {
+					best, bestDays = k, d
+				}
+			}
+			if best >= 0 {
+				charged[stayKey{stays[best].StudentID, stays[best].RoomID}]++
+			}
+		}
+		i = j
+	}
+	return charged, len(periods)
+}
+
+// accommodationPrice is the whole-term price of room r: its schedule, or
+// else the room's own fee.
+func accommodationPrice(schedules []models.FeeSchedule, r models.DormRoom) (float64, *uint, bool) {
+	if fs := matchFeeSchedule(schedules, models.FeeAccommodation, r); fs != nil {
+		return fs.Amount, &fs.ID, true
+	}
+	if r.Fee > 0 {
+		return r.Fee, nil, true
+	}
+	return 0, nil, false
+}
+
+// billAccommodation brings the accommodation bills of term t for students
+// in line with their stays, using the granularity from the configuration.
+// Rooms they stayed in without a bill are charged; bills whose prorated
+// amount changed, after a transfer or check-out, keep their amount and get
+// an adjustment crediting or charging the difference at the price they were
+// issued with. Bills left paid beyond what is now due are reported in
+// result. allowRoom, if set, limits which rooms' bills are written.
+func billAccommodation(tx *gorm.DB, c *gin.Context, t models.Term, students []uint, allowRoom func(models.DormRoom) bool, result *BillingRunResult) error {
+	if len(students) == 0 {
+		return nil
+	}
+	var stays []models.StudentStay
+	err := tx.Where("student_id in ? and start_date <= ? and (end_date is null or end_date > ?)", students, t.EndDate, t.StartDate).
+		Order("student_id, start_date, id").Find(&stays).Error
+	if err != nil {
+		return err
+	}
+	// Lock the bills so that concurrent moves cannot adjust them twice.
+	err = tx.Exec("select id from bills where term_id = ? and fee_type = ? and student_id in ? for update",
+		t.ID, models.FeeAccommodation, students).Error
+	if err != nil {
+		return err
+	}
+	var existing []models.Bill
+	err = billsView(tx).Where("term_id = ? and fee_type = ? and student_id in ?", t.ID, models.FeeAccommodation, students).
+		Order("id").Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	var schedules []models.FeeSchedule
+	if err := tx.Where("term_id = ? and fee_type = ?", t.ID, models.FeeAccommodation).Find(&schedules).Error; err != nil {
+		return err
+	}
+	var keys []stayKey
+	seen := map[stayKey]bool{}
+	roomIDs := []uint{}
+	addKey := func(k stayKey) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+			roomIDs = append(roomIDs, k.roomID)
+		}
+	}
+	for _, s := range stays {
+		addKey(stayKey{s.StudentID, s.RoomID})
+	}
+	billByKey := map[stayKey]*models.Bill{}
+	for i := range existing {
+		k := stayKey{existing[i].StudentID, existing[i].RoomID}
+		billByKey[k] = &existing[i]
+		addKey(k)
+	}
+	// Rooms deleted since the student left are still billed.
+	var rooms []models.DormRoom
+	if err := tx.Unscoped().Where("id in ?", roomIDs).Find(&rooms).Error; err != nil {
+		return err
+	}
+	roomByID := map[uint]models.DormRoom{}
+	for _, r := range rooms {
+		roomByID[r.ID] = r
+	}
+	charged, total := chargedPeriods(t, settings.Proration, stays)
+	for _, k := range keys {
+		r, ok := roomByID[k.roomID]
+		if !ok || (allowRoom != nil && !allowRoom(r)) {
+			continue
+		}
+		share := float64(charged[k]) / float64(total)
+		if b, ok := billByKey[k]; ok {
+			due := roundFen(b.FullAmount * share)
+			diff := roundFen(due - b.DueAmount)
+			if math.Abs(diff) < 0.005 {
+				result.Skipped++
+				continue
+			}
+			adj := models.BillAdjustment{BillID: b.ID, Amount: diff, Reason: models.AdjustProration}
+			if err := tx.Create(&adj).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditCreate, entityBillAdjustment, adj.ID, nil, adj); err != nil {
+				return err
+			}
+			result.Adjusted++
+			if b.PaidAmount > due+0.005 {
+				result.Overpaid = append(result.Overpaid, OverpaidBill{
+					BillID:    b.ID,
+					StudentID: b.StudentID,
+					Amount:    roundFen(b.PaidAmount - due),
+				})
+			}
+			continue
+		}
+		if charged[k] == 0 {
+			continue
+		}
+		price, scheduleID, ok := accommodationPrice(schedules, r)
+		if !ok {
+			result.Unpriced++
+			continue
+		}
+		b := models.Bill{
+			TermID:        t.ID,
+			FeeType:       models.FeeAccommodation,
+			StudentID:     k.studentID,
+			BuildingID:    r.BuildingID,
+			RoomID:        r.ID,
+			FeeScheduleID: scheduleID,
+			FullAmount:    price,
+			Amount:        roundFen(price * share),
+		}
+		if err := tx.Create(&b).Error; err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditCreate, entityBill, b.ID, nil, b); err != nil {
+			return err
+		}
+		result.Created++
+	}
+	return nil
+}
+
+// rebillStudent brings a student's accommodation bills in line with their
+// stays in the open terms still running on day that have been billed, so
+// that a check-in or restore charges the new room, a transfer credits the
+// old room and charges the new one, and a check-out credits the rest of the
+// term. Terms not billed yet are left to their first billing run.
+func rebillStudent(tx *gorm.DB, c *gin.Context, studentID uint, day time.Time) error {
+	var terms []models.Term
+	err := tx.Where("status = ? and end_date >= ? and id in (?)", models.TermOpen, day,
+		tx.Model(&models.Bill{}).Select("term_id").Where("fee_type = ?", models.FeeAccommodation)).
+		Find(&terms).Error
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		// Hold the term open like a billing run; one closed meanwhile keeps
+		// its bills.
+		err := lockOpenTerm(tx, t.ID)
+		if errors.Is(err, errTermClosed) || errors.Is(err, errTermNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Read it again under the lock in case its dates just changed.
+		if err := tx.First(&t, t.ID).Error; err != nil {
+			return err
+		}
+		if err := billAccommodation(tx, c, t, []uint{studentID}, nil, &BillingRunResult{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"dormsystem/config"
+	"dormsystem/models"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func dayPtr(s string) *time.Time {
+	t := day(s)
+	return &t
+}
+
+func term(start, end string) models.Term {
+	return models.Term{ID: 1, StartDate: day(start), EndDate: day(end)}
+}
+
+func TestBillingPeriodsDaily(t *testing.T) {
+	periods := billingPeriods(term("2025-02-27", "2025-03-02"), config.ProrateDaily)
+	want := []string{"2025-02-27", "2025-02-28", "2025-03-01", "2025-03-02"}
+	if len(periods) != len(want) {
+		t.Fatalf("got %d periods, want %d", len(periods), len(want))
+	}
+	for i, p := range periods {
+		if !p[0].Equal(day(want[i])) || !p[1].Equal(day(want[i]).AddDate(0, 0, 1)) {
+			t.Errorf("period %d is %v - %v, want the single day %s", i, p[0], p[1], want[i])
+		}
+	}
+}
+
+func TestBillingPeriodsHalfMonth(t *testing.T) {
+	periods := billingPeriods(term("2025-09-10", "2025-11-20"), config.ProrateHalfMonth)
+	want := [][2]string{
+		{"2025-09-10", "2025-09-16"},
+		{"2025-09-16", "2025-10-01"},
+		{"2025-10-01", "2025-10-16"},
+		{"2025-10-16", "2025-11-01"},
+		{"2025-11-01", "2025-11-16"},
+		{"2025-11-16", "2025-11-21"},
+	}
+	if len(periods) != len(want) {
+		t.Fatalf("got %d periods, want %d: %v", len(periods), len(want), periods)
+	}
+	for i, p := range periods {
+		if !p[0].Equal(day(want[i][0])) || !p[1].Equal(day(want[i][1])) {
+			t.Errorf("period %d is %s - %s, want %s - %s", i,
+				p[0].Format("2006-01-02"), p[1].Format("2006-01-02"), want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestStayDays(t *testing.T) {
+	p := [2]time.Time{day("2025-10-01"), day("2025-10-16")}
+	tests := []struct {
+		name  string
+		start string
+		end   *time.Time
+		want  int
+	}{
+		{"whole period", "2025-09-01", nil, 15},
+		{"moved in during", "2025-10-06", nil, 10},
+		{"moved out during", "2025-09-01", dayPtr("2025-10-04"), 3},
+		{"in and out during", "2025-10-03", dayPtr("2025-10-08"), 5},
+		{"left before", "2025-09-01", dayPtr("2025-10-01"), 0},
+		{"arrived after", "2025-10-16", nil, 0},
+	}
+	for _, tt := range tests {
+		s := models.StudentStay{StartDate: day(tt.start), EndDate: tt.end}
+		if got := stayDays(p, s); got != tt.want {
+			t.Errorf("%s: got %d days, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChargedPeriodsDaily(t *testing.T) {
+	tm := term("2025-10-01", "2025-10-31")
+	stays := []models.StudentStay{
+		{StudentID: 1, RoomID: 10, StartDate: day("2025-09-01"), EndDate: dayPtr("2025-10-11")},
+		{StudentID: 1, RoomID: 20, StartDate: day("2025-10-11")},
+		{StudentID: 2, RoomID: 10, StartDate: day("2025-10-21")},
+	}
+	charged, total := chargedPeriods(tm, config.ProrateDaily, stays)
+	if total != 31 {
+		t.Fatalf("got %d periods, want 31", total)
+	}
+	want := map[stayKey]int{{1, 10}: 10, {1, 20}: 21, {2, 10}: 11}
+	for k, n := range want {
+		if charged[k] != n {
+			t.Errorf("student %d room %d: charged %d days, want %d", k.studentID, k.roomID, charged[k], n)
+		}
+	}
+	if len(charged) != len(want) {
+		t.Errorf("charged %v, want only %v", charged, want)
+	}
+}
+
+func TestChargedPeriodsHalfMonth(t *testing.T) {
+	tm := term("2025-10-01", "2025-11-30")
+	stays := []models.StudentStay{
+		// Moved on the 10th: nine days of the first half of October were
+		// in room 10 and six in room 20, so room 10 is charged for it.
+		{StudentID: 1, RoomID: 10, StartDate: day("2025-09-01"), EndDate: dayPtr("2025-10-10")},
+		{StudentID: 1, RoomID: 20, StartDate: day("2025-10-10")},
+		// Checked out on the 8th of November; the half started is charged.
+		{StudentID: 2, RoomID: 30, StartDate: day("2025-09-01"), EndDate: dayPtr("2025-11-08")},
+		// A tie goes to the later room.
+		{StudentID: 3, RoomID: 40, StartDate: day("2025-09-01"), EndDate: dayPtr("2025-10-24")},
+		{StudentID: 3, RoomID: 50, StartDate: day("2025-10-24")},
+	}
+	charged, total := chargedPeriods(tm, config.ProrateHalfMonth, stays)
+	if total != 4 {
+		t.Fatalf("got %d periods, want 4", total)
+	}
+	want := map[stayKey]int{
+		{1, 10}: 1, {1, 20}: 3,
+		{2, 30}: 3,
+		{3, 40}: 1, {3, 50}: 3,
+	}
+	for k, n := range want {
+		if charged[k] != n {
+			t.Errorf("student %d room %d: charged %d periods, want %d", k.studentID, k.roomID, charged[k], n)
+		}
+	}
+	if len(charged) != len(want) {
+		t.Errorf("charged %v, want only %v", charged, want)
+	}
+}
@@ -1,18 +1,30 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
+	"dormsystem/validation"
 )
 
 func ListRooms(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
 	var list []models.DormRoom
-	query := db.DB.Model(&models.DormRoom{})
+	query, ok := applyDeletedFilter(c, scope.apply(db.DB.Model(&models.DormRoom{}), "building_id"), "deleted_at")
+	if !ok {
+		return
+	}
 	keyword := c.Query("keyword")
 	if keyword != "" {
 		query = query.Where("room_no = ?", keyword)
@@ -30,61 +42,143 @@ func ListRooms(c *gin.Context) {
 
 func CreateRoom(c *gin.Context) {
 	var r models.DormRoom
-	if err := c.ShouldBindJSON(&r); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &r) {
 		return
 	}
+	r.DeletedAt = gorm.DeletedAt{}
+	r.Version = 1
 	if r.BuildingID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "所属公寓不能为空"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingRequired)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
 		return
 	}
 	var b models.ApartmentBuilding
 	if err := db.DB.First(&b, r.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "所属公寓不存在"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
 		return
 	}
-	if err := db.DB.Create(&r).Error; err != nil {
-		respondDBError(c, err, "创建失败")
+	if invalid(c, validation.Room(r, b)) {
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&r).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityRoom, r.ID, nil, r)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
 		return
 	}
 	c.JSON(http.StatusOK, r)
 }
 
+func GetRoom(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var r models.DormRoom
+	if err := db.DB.First(&r, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	respondVersioned(c, r.Version, r)
+}
+
+// LookupRoom finds a room by its building number and room number, the way
+// staff usually name a room.
+func LookupRoom(c *gin.Context) {
+	buildingNo := strings.TrimSpace(c.Query("buildingNo"))
+	roomNo := strings.TrimSpace(c.Query("roomNo"))
+	if buildingNo == "" || roomNo == "" {
+		respondError(c, http.StatusBadRequest, errcode.BuildingAndRoomRequired)
+		return
+	}
+	var r models.DormRoom
+	err := db.DB.Joins("JOIN apartment_buildings ON apartment_buildings.id = dorm_rooms.building_id and apartment_buildings.deleted_at is null").
+		Where("apartment_buildings.building_no = ? and dorm_rooms.room_no = ?", buildingNo, roomNo).
+		First(&r).Error
+	if err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	respondVersioned(c, r.Version, r)
+}
+
 func UpdateRoom(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
 		return
 	}
 	var r models.DormRoom
 	if err := db.DB.First(&r, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		respondError(c, http.StatusNotFound, errcode.NotFound)
 		return
 	}
 	var req models.DormRoom
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
 	if req.BuildingID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "所属公寓不能为空"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingRequired)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID, req.BuildingID) {
+		return
+	}
+	if !checkIfMatch(c, r.Version, r) {
 		return
 	}
 	var b models.ApartmentBuilding
 	if err := db.DB.First(&b, req.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "所属公寓不存在"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
 		return
 	}
+	if invalid(c, validation.RoomUpdate(r, req, b)) {
+		return
+	}
+	before := r
+	version := r.Version
+	r.Version++
 	r.RoomNo = req.RoomNo
 	r.Capacity = req.Capacity
 	r.Fee = req.Fee
 	r.Phone = req.Phone
+	r.RoomType = req.RoomType
 	r.BuildingID = req.BuildingID
-	if err := db.DB.Save(&r).Error; err != nil {
-		respondDBError(c, err, "更新失败")
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &r, version); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityRoom, r.ID, before, r)
+	})
+	if errors.Is(err, errStaleVersion) {
+		var cur models.DormRoom
+		if err := db.DB.First(&cur, r.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
 		return
 	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, r.Version)
 	c.JSON(http.StatusOK, r)
 }
 
@@ -92,11 +186,43 @@ func DeleteRoom(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var r models.DormRoom
+	if err := db.DB.First(&r, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	d, err := countDependencies(db.DB, "room_id", r.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
 		return
 	}
-	if err := db.DB.Delete(&models.DormRoom{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+	cascade, ok := checkDeletable(c, d, r.RoomNo)
+	if !ok {
+		return
+	}
+	day, ok := moveDate(c)
+	if !ok {
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			if err := cascadeDelete(tx, c, entityStudent, "room_id", r.ID, day); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&r).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditDelete, entityRoom, r.ID, r, nil)
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
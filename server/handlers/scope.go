@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+const ctxBuildingScope = "buildingScope"
+
+// buildingScope is the set of buildings the caller may see and change.
+// Managers are limited to the buildings assigned to them; every other role
+// works across all buildings.
+type buildingScope struct {
+	all bool
+	ids []uint
+}
+
+func (s buildingScope) allows(buildingID uint) bool {
+	if s.all {
+		return true
+	}
+	for _, id := range s.ids {
+		if id == buildingID {
+			return true
+		}
+	}
+	return false
+}
+
+// apply restricts query to rows whose column is one of the scope's buildings.
+func (s buildingScope) apply(query *gorm.DB, column string) *gorm.DB {
+	if s.all {
+		return query
+	}
+	if len(s.ids) == 0 {
+		return query.Where("1 = 0")
+	}
+	return query.Where(column+" in ?", s.ids)
+}
+
+func loadBuildingScope(c *gin.Context) (buildingScope, error) {
+	if v, ok := c.Get(ctxBuildingScope); ok {
+		return v.(buildingScope), nil
+	}
+	u, _ := currentUser(c)
+	scope := buildingScope{all: true}
+	if u.Role == RoleManager {
+		scope.all = false
+		if err := db.DB.Model(&models.UserBuilding{}).
+			Where("user_id = ?", u.ID).
+			Pluck("building_id", &scope.ids).Error; err != nil {
+			return buildingScope{}, err
+		}
+	}
+	c.Set(ctxBuildingScope, scope)
+	return scope, nil
+}
+
+// callerScope loads the caller's scope and answers 500 itself on failure.
+func callerScope(c *gin.Context) (buildingScope, bool) {
+	scope, err := loadBuildingScope(c)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return buildingScope{}, false
+	}
+	return scope, true
+}
+
+// requireBuildings answers 403 unless the caller may change every building
+// in ids.
+func requireBuildings(c *gin.Context, ids ...uint) bool {
+	scope, ok := callerScope(c)
+	if !ok {
+		return false
+	}
+	for _, id := range ids {
+		if !scope.allows(id) {
+			respondError(c, http.StatusForbidden, errcode.BuildingForbidden)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import "dormsystem/config"
+
+// settings is the configuration the server started with. Handlers read it
+// rather than the environment, so every request sees the same validated
+// values.
+var settings = config.Load()
+
+// Configure sets the configuration the handlers use. main calls it once the
+// configuration is validated, before serving requests or running commands.
+func Configure(cfg config.Config) {
+	settings = cfg
+}
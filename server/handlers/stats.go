@@ -2,41 +2,70 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 )
 
 type BuildingOccupancyStat struct {
+	BuildingID    uint    `json:"buildingID"`
+	BuildingNo    string  `json:"buildingNo"`
+	TotalCapacity int     `json:"totalCapacity"`
+	OccupiedBeds  int     `json:"occupiedBeds"`
+	OccupancyRate float64 `json:"occupancyRate"`
+}
+
+type BuildingPaymentSummary struct {
 	BuildingID     uint    `json:"buildingID"`
 	BuildingNo     string  `json:"buildingNo"`
-	TotalCapacity  int     `json:"totalCapacity"`
-	OccupiedBeds   int     `json:"occupiedBeds"`
-	OccupancyRate  float64 `json:"occupancyRate"`
+	TotalAmount    float64 `json:"totalAmount"`
+	VoidedAmount   float64 `json:"voidedAmount"`
+	ReversedAmount float64 `json:"reversedAmount"`
 }
 
-type BuildingPaymentSummary struct {
-	BuildingID  uint    `json:"buildingID"`
-	BuildingNo  string  `json:"buildingNo"`
-	TotalAmount float64 `json:"totalAmount"`
+// statsView reads view, or its per term counterpart when ?termID is given.
+func statsView(c *gin.Context, view, termView string) *gorm.DB {
+	termIDStr := c.Query("termID")
+	if termIDStr != "" {
+		if id, err := strconv.Atoi(termIDStr); err == nil && id > 0 {
+			return db.DB.Table(termView).Where("term_id = ?", id)
+		}
+	}
+	return db.DB.Table(view)
 }
 
+// GetBuildingOccupancy reports current occupancy, or with ?termID the
+// students who stayed in each building during that term.
 func GetBuildingOccupancy(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
 	var list []BuildingOccupancyStat
-	if err := db.DB.Raw(`select building_id, building_no, total_capacity, occupied_beds, occupancy_rate from v_building_occupancy`).Scan(&list).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询入住率统计失败"})
+	query := scope.apply(statsView(c, "v_building_occupancy", "v_building_term_occupancy"), "building_id").
+		Select("building_id, building_no, total_capacity, occupied_beds, occupancy_rate")
+	if err := query.Scan(&list).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
 		return
 	}
 	c.JSON(http.StatusOK, list)
 }
 
 func GetBuildingPaymentSummary(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
+	}
 	var list []BuildingPaymentSummary
-	if err := db.DB.Raw(`select building_id, building_no, total_amount from v_building_payment_summary`).Scan(&list).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询收费统计失败"})
+	query := scope.apply(statsView(c, "v_building_payment_summary", "v_building_term_payment_summary"), "building_id").
+		Select("building_id, building_no, total_amount, voided_amount, reversed_amount")
+	if err := query.Scan(&list).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
 		return
 	}
 	c.JSON(http.StatusOK, list)
 }
-
@@ -5,13 +5,15 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	pgxpgconn "github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
+	"dormsystem/validation"
 )
 
 func paginateParams(c *gin.Context) (int, int, bool) {
@@ -39,7 +41,7 @@ func applyPagination(c *gin.Context, query *gorm.DB, out interface{}) bool {
 	limit, offset, usePagination := paginateParams(c)
 	if !usePagination {
 		if err := query.Find(out).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+			respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
 			return false
 		}
 		c.JSON(http.StatusOK, out)
@@ -47,11 +49,11 @@ func applyPagination(c *gin.Context, query *gorm.DB, out interface{}) bool {
 	}
 	var total int64
 	if err := query.Count(&total).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
 		return false
 	}
 	if err := query.Limit(limit).Offset(offset).Find(out).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
 		return false
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -61,73 +63,30 @@ func applyPagination(c *gin.Context, query *gorm.DB, out interface{}) bool {
 	return true
 }
 
-func respondDBError(c *gin.Context, err error, defaultMsg string) {
-	msg := err.Error()
-	constraint := ""
-
-	var pgErr *pgxpgconn.PgError
-	if errors.As(err, &pgErr) {
-		if pgErr.ConstraintName != "" {
-			constraint = pgErr.ConstraintName
-		}
-		if msg == "" {
-			msg = pgErr.Message
-		}
+func ListStudents(c *gin.Context) {
+	scope, ok := callerScope(c)
+	if !ok {
+		return
 	}
-
-	if constraint == "" {
-		switch {
-		case strings.Contains(msg, "chk_building_floor_count"):
-			constraint = "chk_building_floor_count"
-		case strings.Contains(msg, "chk_building_room_count"):
-			constraint = "chk_building_room_count"
-		case strings.Contains(msg, "chk_room_capacity"):
-			constraint = "chk_room_capacity"
-		case strings.Contains(msg, "chk_room_fee_nonnegative"):
-			constraint = "chk_room_fee_nonnegative"
-		case strings.Contains(msg, "chk_student_gender"):
-			constraint = "chk_student_gender"
-		case strings.Contains(msg, "chk_payment_amount"):
-			constraint = "chk_payment_amount"
-		case strings.Contains(msg, "chk_payment_type"):
-			constraint = "chk_payment_type"
-		}
+	buildingID := 0
+	if id, err := strconv.Atoi(c.Query("buildingID")); err == nil && id > 0 {
+		buildingID = id
 	}
-
-	switch constraint {
-	case "chk_building_floor_count":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "楼层数必须大于0"})
-		return
-	case "chk_building_room_count":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "房间数不能为负数"})
-		return
-	case "chk_room_capacity":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室容量必须大于0"})
-		return
-	case "chk_room_fee_nonnegative":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室费用不能为负数"})
-		return
-	case "chk_student_gender":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "性别只能是男或女"})
-		return
-	case "chk_payment_amount":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "金额必须大于0"})
-		return
-	case "chk_payment_type":
-		c.JSON(http.StatusBadRequest, gin.H{"error": "收费类型必须是住宿费、水电费或押金"})
+	buildingNo := strings.TrimSpace(c.Query("buildingNo"))
+	roomNo := strings.TrimSpace(c.Query("roomNo"))
+	// A room number is only unique within a building, so it must come with
+	// buildingID or buildingNo.
+	if roomNo != "" && buildingID == 0 && buildingNo == "" {
+		var errs validation.Errors
+		errs.Add("buildingID", errcode.BuildingRequired)
+		invalid(c, errs)
 		return
-	default:
-		if strings.Contains(msg, "寝室不存在") || strings.Contains(msg, "寝室人数已满") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
-			return
-		}
 	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": defaultMsg})
-}
-
-func ListStudents(c *gin.Context) {
 	var students []models.Student
-	query := db.DB.Model(&models.Student{})
+	query, ok := applyDeletedFilter(c, scope.apply(db.DB.Model(&models.Student{}), "students.building_id"), "students.deleted_at")
+	if !ok {
+		return
+	}
 	keyword := strings.TrimSpace(c.Query("keyword"))
 	if keyword != "" {
 		query = query.Where(
@@ -137,82 +96,261 @@ func ListStudents(c *gin.Context) {
 				Or("class_name = ?", keyword),
 		)
 	}
-	roomNo := strings.TrimSpace(c.Query("roomNo"))
+	if buildingID != 0 {
+		query = query.Where("students.building_id = ?", buildingID)
+	}
 	if roomNo != "" {
-		query = query.Joins("JOIN dorm_rooms ON dorm_rooms.id = students.room_id").
+		query = query.Joins("JOIN dorm_rooms ON dorm_rooms.id = students.room_id and dorm_rooms.deleted_at is null").
 			Where("dorm_rooms.room_no = ?", roomNo)
+		if buildingNo != "" {
+			query = query.Joins("JOIN apartment_buildings ON apartment_buildings.id = dorm_rooms.building_id").
+				Where("apartment_buildings.building_no = ?", buildingNo)
+		}
 	}
 	if applyPagination(c, query, &students) {
 		return
 	}
 }
 
+// moveDate is the day a check-in, transfer or check-out took effect: the
+// ?moveDate parameter, or today.
+func moveDate(c *gin.Context) (time.Time, bool) {
+	v := c.Query("moveDate")
+	if v == "" {
+		y, m, d := time.Now().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), true
+	}
+	day, err := parseTimeParam(v)
+	if err != nil {
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "moveDate"})
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// setMoveDate dates the stays the student trigger writes in tx.
+func setMoveDate(tx *gorm.DB, day time.Time) error {
+	return tx.Exec("select set_config('dorm.move_date', ?, true)", day.Format("2006-01-02")).Error
+}
+
 func CreateStudent(c *gin.Context) {
 	var s models.Student
-	if err := c.ShouldBindJSON(&s); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &s) {
+		return
+	}
+	s.DeletedAt = gorm.DeletedAt{}
+	s.Version = 1
+	if invalid(c, validation.Student(s)) {
 		return
 	}
 	if s.BuildingID == 0 || s.RoomID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓号和寝室号不能为空"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingAndRoomRequired)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID) {
 		return
 	}
 	var b models.ApartmentBuilding
 	if err := db.DB.First(&b, s.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓不存在"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
 		return
 	}
 	var r models.DormRoom
 	if err := db.DB.First(&r, s.RoomID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不存在"})
+		respondError(c, http.StatusBadRequest, errcode.RoomNotFound)
 		return
 	}
 	if r.BuildingID != s.BuildingID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不属于该公寓"})
+		respondError(c, http.StatusBadRequest, errcode.RoomNotInBuilding)
 		return
 	}
-	if err := db.DB.Create(&s).Error; err != nil {
-		respondDBError(c, err, "创建失败")
+	day, ok := moveDate(c)
+	if !ok {
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		if err := tx.Create(&s).Error; err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditCreate, entityStudent, s.ID, nil, s); err != nil {
+			return err
+		}
+		return rebillStudent(tx, c, s.ID, day)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
 		return
 	}
 	c.JSON(http.StatusOK, s)
 }
 
+// maxImportRows bounds one import request so it fits in one transaction.
+const maxImportRows = 1000
+
+type ImportRowError struct {
+	Row    int               `json:"row"`
+	Fields validation.Errors `json:"fields"`
+}
+
+// ImportStudents creates a batch of students in one transaction. Every row
+// goes through the same checks as CreateStudent and nothing is written
+// unless all of them pass.
+func ImportStudents(c *gin.Context) {
+	var list []models.Student
+	if !bindJSON(c, &list) {
+		return
+	}
+	if len(list) == 0 || len(list) > maxImportRows {
+		respondError(c, http.StatusBadRequest, errcode.ImportSize, maxImportRows)
+		return
+	}
+	buildingIDs := make([]uint, 0, len(list))
+	for _, s := range list {
+		buildingIDs = append(buildingIDs, s.BuildingID)
+	}
+	if !requireBuildings(c, buildingIDs...) {
+		return
+	}
+	rooms := map[uint]*models.DormRoom{}
+	seen := map[string]bool{}
+	var rowErrs []ImportRowError
+	for i := range list {
+		s := &list[i]
+		s.ID = 0
+		s.DeletedAt = gorm.DeletedAt{}
+		s.Version = 1
+		errs := validation.Student(*s)
+		if seen[s.StudentNo] {
+			errs.Add("studentNo", errcode.ImportDuplicate)
+		}
+		seen[s.StudentNo] = true
+		if s.BuildingID == 0 || s.RoomID == 0 {
+			errs.Add("roomID", errcode.BuildingAndRoomRequired)
+		} else {
+			r, ok := rooms[s.RoomID]
+			if !ok {
+				var room models.DormRoom
+				if err := db.DB.First(&room, s.RoomID).Error; err == nil {
+					r = &room
+				}
+				rooms[s.RoomID] = r
+			}
+			if r == nil {
+				errs.Add("roomID", errcode.RoomNotFound)
+			} else if r.BuildingID != s.BuildingID {
+				errs.Add("roomID", errcode.RoomNotInBuilding)
+			}
+		}
+		if len(errs) > 0 {
+			rowErrs = append(rowErrs, ImportRowError{Row: i + 1, Fields: errs})
+		}
+	}
+	if len(rowErrs) > 0 {
+		for i := range rowErrs {
+			rowErrs[i].Fields = rowErrs[i].Fields.Localize(requestLang(c))
+		}
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidRequest, gin.H{"rows": rowErrs})
+		return
+	}
+	day, ok := moveDate(c)
+	if !ok {
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		for i := range list {
+			if err := tx.Create(&list[i]).Error; err != nil {
+				return err
+			}
+			if err := writeAudit(tx, c, auditCreate, entityStudent, list[i].ID, nil, list[i]); err != nil {
+				return err
+			}
+			if err := rebillStudent(tx, c, list[i].ID, day); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.ImportFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": len(list)})
+}
+
+func GetStudent(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var s models.Student
+	if err := db.DB.First(&s, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID) {
+		return
+	}
+	respondVersioned(c, s.Version, s)
+}
+
 func UpdateStudent(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
 		return
 	}
 	var s models.Student
 	if err := db.DB.First(&s, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		respondError(c, http.StatusNotFound, errcode.NotFound)
 		return
 	}
 	var req models.Student
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
+		return
+	}
+	if invalid(c, validation.StudentUpdate(s, req)) {
 		return
 	}
 	if req.BuildingID == 0 || req.RoomID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓号和寝室号不能为空"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingAndRoomRequired)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID, req.BuildingID) {
+		return
+	}
+	if !checkIfMatch(c, s.Version, s) {
 		return
 	}
 	var b models.ApartmentBuilding
 	if err := db.DB.First(&b, req.BuildingID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "公寓不存在"})
+		respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
 		return
 	}
 	var r models.DormRoom
 	if err := db.DB.First(&r, req.RoomID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不存在"})
+		respondError(c, http.StatusBadRequest, errcode.RoomNotFound)
 		return
 	}
 	if r.BuildingID != req.BuildingID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "寝室不属于该公寓"})
+		respondError(c, http.StatusBadRequest, errcode.RoomNotInBuilding)
+		return
+	}
+	day, ok := moveDate(c)
+	if !ok {
 		return
 	}
+	before := s
+	version := s.Version
+	s.Version++
 	s.StudentNo = req.StudentNo
 	s.Name = req.Name
 	s.Gender = req.Gender
@@ -222,10 +360,35 @@ func UpdateStudent(c *gin.Context) {
 	s.Phone = req.Phone
 	s.BuildingID = req.BuildingID
 	s.RoomID = req.RoomID
-	if err := db.DB.Save(&s).Error; err != nil {
-		respondDBError(c, err, "更新失败")
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		if err := saveVersioned(tx, &s, version); err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditUpdate, entityStudent, s.ID, before, s); err != nil {
+			return err
+		}
+		if s.RoomID == before.RoomID {
+			return nil
+		}
+		return rebillStudent(tx, c, s.ID, day)
+	})
+	if errors.Is(err, errStaleVersion) {
+		var cur models.Student
+		if err := db.DB.First(&cur, s.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
 		return
 	}
+	setETag(c, s.Version)
 	c.JSON(http.StatusOK, s)
 }
 
@@ -233,12 +396,59 @@ func DeleteStudent(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var s models.Student
+	if err := db.DB.First(&s, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID) {
+		return
+	}
+	day, ok := moveDate(c)
+	if !ok {
 		return
 	}
-	if err := db.DB.Delete(&models.Student{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		if err := tx.Delete(&s).Error; err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditDelete, entityStudent, s.ID, s, nil); err != nil {
+			return err
+		}
+		return rebillStudent(tx, c, s.ID, day)
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
+
+// ListStudentStays lists the rooms a student has lived in, latest first.
+func ListStudentStays(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var s models.Student
+	if err := db.DB.Unscoped().First(&s, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !requireBuildings(c, s.BuildingID) {
+		return
+	}
+	var list []models.StudentStay
+	query := db.DB.Model(&models.StudentStay{}).Where("student_id = ?", s.ID).Order("start_date desc, id desc")
+	if applyPagination(c, query, &list) {
+		return
+	}
+}
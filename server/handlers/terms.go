@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+	"dormsystem/validation"
+)
+
+type TermRequest struct {
+	Name      string `json:"name"`
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+}
+
+var (
+	errTermNotFound = errors.New("term not found")
+	errTermClosed   = errors.New("term closed")
+	errTermOverlap  = errors.New("term overlap")
+)
+
+// lockOpenTerm checks inside tx that the term exists and is open, holding
+// it so that it cannot be closed before tx commits.
+func lockOpenTerm(tx *gorm.DB, id uint) error {
+	var status string
+	res := tx.Raw("select status from terms where id = ? for share", id).Scan(&status)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errTermNotFound
+	}
+	if status != models.TermOpen {
+		return errTermClosed
+	}
+	return nil
+}
+
+// respondTermError answers for the errors of lockOpenTerm and reports
+// whether err was one of them.
+func respondTermError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, errTermNotFound):
+		respondError(c, http.StatusBadRequest, errcode.TermNotFound)
+	case errors.Is(err, errTermClosed):
+		respondError(c, http.StatusConflict, errcode.TermClosed)
+	default:
+		return false
+	}
+	return true
+}
+
+// termOn is the term whose dates include day, or nil if there is none.
+func termOn(tx *gorm.DB, day time.Time) (*uint, error) {
+	var t models.Term
+	err := tx.Where("start_date <= ? and end_date >= ?", day, day).Order("start_date desc").First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t.ID, nil
+}
+
+// bindTerm reads a term request into t.
+func bindTerm(c *gin.Context, t *models.Term) bool {
+	var req TermRequest
+	if !bindJSON(c, &req) {
+		return false
+	}
+	startDate, err := parseTimeParam(req.StartDate)
+	if err != nil {
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "startDate"})
+		return false
+	}
+	endDate, err := parseTimeParam(req.EndDate)
+	if err != nil {
+		respondErrorWith(c, http.StatusBadRequest, errcode.InvalidDate, gin.H{"field": "endDate"})
+		return false
+	}
+	t.Name = req.Name
+	t.StartDate = startDate
+	t.EndDate = endDate
+	return !invalid(c, validation.Term(*t))
+}
+
+// checkTermOverlap fails with errTermOverlap if t shares a day with another
+// term. The table lock keeps two requests from adding overlapping terms.
+func checkTermOverlap(tx *gorm.DB, t models.Term) error {
+	if err := tx.Exec("lock table terms in share row exclusive mode").Error; err != nil {
+		return err
+	}
+	var n int64
+	err := tx.Model(&models.Term{}).
+		Where("id <> ? and start_date <= ? and end_date >= ?", t.ID, t.EndDate, t.StartDate).
+		Count(&n).Error
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errTermOverlap
+	}
+	return nil
+}
+
+func ListTerms(c *gin.Context) {
+	var list []models.Term
+	query := db.DB.Model(&models.Term{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if applyPagination(c, query.Order("start_date desc"), &list) {
+		return
+	}
+}
+
+// CreateTerm adds a term. New terms are open.
+func CreateTerm(c *gin.Context) {
+	t := models.Term{Status: models.TermOpen, Version: 1}
+	if !bindTerm(c, &t) {
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTermOverlap(tx, t); err != nil {
+			return err
+		}
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityTerm, t.ID, nil, t)
+	})
+	if errors.Is(err, errTermOverlap) {
+		respondError(c, http.StatusConflict, errcode.TermOverlap)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func GetTerm(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var t models.Term
+	if err := db.DB.First(&t, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	respondVersioned(c, t.Version, t)
+}
+
+// UpdateTerm renames a term or moves its dates. Payments already assigned
+// to it keep their term.
+func UpdateTerm(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var t models.Term
+	if err := db.DB.First(&t, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !checkIfMatch(c, t.Version, t) {
+		return
+	}
+	before := t
+	if !bindTerm(c, &t) {
+		return
+	}
+	version := t.Version
+	t.Version++
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTermOverlap(tx, t); err != nil {
+			return err
+		}
+		if err := saveVersioned(tx, &t, version); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityTerm, t.ID, before, t)
+	})
+	if errors.Is(err, errTermOverlap) {
+		respondError(c, http.StatusConflict, errcode.TermOverlap)
+		return
+	}
+	if errors.Is(err, errStaleVersion) {
+		var cur models.Term
+		if err := db.DB.First(&cur, t.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, t.Version)
+	c.JSON(http.StatusOK, t)
+}
+
+// setTermStatus opens or closes the term named by :id.
+func setTermStatus(c *gin.Context, status, action string) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var t models.Term
+	if err := db.DB.First(&t, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if t.Status == status {
+		if status == models.TermOpen {
+			respondError(c, http.StatusConflict, errcode.TermAlreadyOpen)
+		} else {
+			respondError(c, http.StatusConflict, errcode.TermAlreadyClosed)
+		}
+		return
+	}
+	before := t
+	version := t.Version
+	t.Version++
+	t.Status = status
+	t.ClosedAt = nil
+	if status == models.TermClosed {
+		now := time.Now()
+		t.ClosedAt = &now
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &t, version); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, action, entityTerm, t.ID, before, t)
+	})
+	if errors.Is(err, errStaleVersion) {
+		var cur models.Term
+		if err := db.DB.First(&cur, t.ID).Error; err != nil {
+			respondError(c, http.StatusNotFound, errcode.NotFound)
+			return
+		}
+		respondStale(c, cur.Version, cur)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	setETag(c, t.Version)
+	c.JSON(http.StatusOK, t)
+}
+
+// OpenTerm reopens a closed term so that it can be billed again.
+func OpenTerm(c *gin.Context) {
+	setTermStatus(c, models.TermOpen, auditOpen)
+}
+
+// CloseTerm stops new schedules and billing runs for a term. Payments
+// against its bills are still taken.
+func CloseTerm(c *gin.Context) {
+	setTermStatus(c, models.TermClosed, auditClose)
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func signAccessToken(u models.User, jti string, now time.Time) (string, error) {
+	return signClaims(AuthClaims{
+		UserID:             u.ID,
+		Username:           u.Username,
+		Role:               u.Role,
+		MustChangePassword: u.MustChangePassword,
+		MustEnrollTOTP:     requiresTOTP(u.Role) && !u.TOTPEnabled,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.FormatUint(uint64(u.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(settings.AccessTokenTTL)),
+		},
+	})
+}
+
+// issueSession starts a new session for u and returns its first token pair.
+func issueSession(tx *gorm.DB, u models.User) (LoginResponse, error) {
+	now := time.Now()
+	jti, err := randomToken(16)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	access, err := signAccessToken(u, jti, now)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	rt := models.RefreshToken{
+		UserID:    u.ID,
+		TokenHash: hashToken(refresh),
+		AccessJTI: jti,
+		ExpiresAt: now.Add(settings.RefreshTokenTTL),
+	}
+	if err := tx.Create(&rt).Error; err != nil {
+		return LoginResponse{}, err
+	}
+	return LoginResponse{
+		Token:              access,
+		RefreshToken:       refresh,
+		ExpiresIn:          int64(settings.AccessTokenTTL.Seconds()),
+		MustChangePassword: u.MustChangePassword,
+		MustEnrollTOTP:     requiresTOTP(u.Role) && !u.TOTPEnabled,
+	}, nil
+}
+
+// denyAccessToken puts jti on the denylist until the longest time an access
+// token issued now could still be valid.
+func denyAccessToken(tx *gorm.DB, jti string) error {
+	if jti == "" {
+		return nil
+	}
+	return tx.Exec(
+		"insert into revoked_tokens (jti, expires_at) values (?, ?) on conflict (jti) do nothing",
+		jti, time.Now().Add(settings.AccessTokenTTL),
+	).Error
+}
+
+// revokeUserSessions ends every active session of a user, including the access
+// tokens already handed out for them.
+func revokeUserSessions(tx *gorm.DB, userID uint) error {
+	var list []models.RefreshToken
+	if err := tx.Where("user_id = ? and revoked_at is null", userID).Find(&list).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rt := range list {
+		if err := denyAccessToken(tx, rt.AccessJTI); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.RefreshToken{}).Where("id = ?", rt.ID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTokenRevoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	var count int64
+	if err := db.DB.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		// Fail closed: a token we cannot check is treated as revoked.
+		return true
+	}
+	return count > 0
+}
+
+func purgeExpiredTokens() {
+	now := time.Now()
+	if err := db.DB.Where("expires_at < ?", now).Delete(&models.RevokedToken{}).Error; err != nil {
+		log.Println("purge revoked tokens error", err)
+	}
+	if err := db.DB.Where("expires_at < ?", now).Delete(&models.RefreshToken{}).Error; err != nil {
+		log.Println("purge refresh tokens error", err)
+	}
+	if err := db.DB.Where("expires_at < ?", now).Delete(&models.LoginChallenge{}).Error; err != nil {
+		log.Println("purge login challenges error", err)
+	}
+}
+
+func startTokenPurger() {
+	purgeExpiredTokens()
+	go func() {
+		for range time.Tick(time.Hour) {
+			purgeExpiredTokens()
+		}
+	}()
+}
+
+// checkRefreshToken says whether rt may be rotated at now. A token that was
+// already rotated or revoked is reported as reused, even once expired.
+func checkRefreshToken(rt models.RefreshToken, now time.Time) error {
+	if rt.RevokedAt != nil {
+		return errRefreshTokenReused
+	}
+	if now.After(rt.ExpiresAt) {
+		return errInvalidRefreshToken
+	}
+	return nil
+}
+
+func RefreshAccessToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest)
+		return
+	}
+	var resp LoginResponse
+	reused := false
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var rt models.RefreshToken
+		if err := tx.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&rt).Error; err != nil {
+			return errInvalidRefreshToken
+		}
+		switch err := checkRefreshToken(rt, time.Now()); {
+		case errors.Is(err, errRefreshTokenReused):
+			// A rotated token was presented again, so it has leaked. End
+			// every session of the user rather than guess which is genuine.
+			log.Printf("refresh token reuse detected for user %d", rt.UserID)
+			reused = true
+			return revokeUserSessions(tx, rt.UserID)
+		case err != nil:
+			return err
+		}
+		var u models.User
+		if err := tx.First(&u, rt.UserID).Error; err != nil {
+			return errInvalidRefreshToken
+		}
+		if err := tx.Model(&rt).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		var err error
+		resp, err = issueSession(tx, u)
+		return err
+	})
+	switch {
+	case err == nil && reused:
+		respondError(c, http.StatusUnauthorized, errcode.RefreshTokenRevoked)
+	case err == nil:
+		c.JSON(http.StatusOK, resp)
+	case errors.Is(err, errInvalidRefreshToken):
+		respondError(c, http.StatusUnauthorized, errcode.InvalidRefreshToken)
+	default:
+		respondError(c, http.StatusInternalServerError, errcode.RefreshFailed)
+	}
+}
+
+func Logout(c *gin.Context) {
+	me, _ := currentUser(c)
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := denyAccessToken(tx, me.TokenID); err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? and access_jti = ? and revoked_at is null", me.ID, me.TokenID).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.LogoutFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"dormsystem/config"
+	"dormsystem/models"
+)
+
+// useHS256 installs a signing key ring for secret and the previous ones
+// for the duration of the test.
+func useHS256(t *testing.T, secret string, previous ...string) {
+	t.Helper()
+	ring, err := loadKeyRing(config.Config{JWTAlgorithm: "HS256", JWTSecret: secret, JWTPreviousSecrets: previous})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := jwtKeys
+	jwtKeys = ring
+	t.Cleanup(func() { jwtKeys = saved })
+}
+
+func TestCheckRefreshToken(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	rotated := now.Add(-time.Minute)
+	tests := []struct {
+		name string
+		rt   models.RefreshToken
+		want error
+	}{
+		{"active", models.RefreshToken{ExpiresAt: now.Add(time.Hour)}, nil},
+		{"expired", models.RefreshToken{ExpiresAt: now.Add(-time.Second)}, errInvalidRefreshToken},
+		{"rotated", models.RefreshToken{ExpiresAt: now.Add(time.Hour), RevokedAt: &rotated}, errRefreshTokenReused},
+		{"rotated and expired", models.RefreshToken{ExpiresAt: now.Add(-time.Second), RevokedAt: &rotated}, errRefreshTokenReused},
+	}
+	for _, tt := range tests {
+		if err := checkRefreshToken(tt.rt, now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHashTokenIsStable(t *testing.T) {
+	a, err := randomToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := randomToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("two random tokens are equal")
+	}
+	if hashToken(a) != hashToken(a) || hashToken(a) == hashToken(b) {
+		t.Error("hashToken must be stable and tell tokens apart")
+	}
+	if strings.Contains(hashToken(a), a) {
+		t.Error("the hash contains the token")
+	}
+}
+
+func TestAccessTokenRoundTrip(t *testing.T) {
+	useHS256(t, strings.Repeat("n", 32))
+	now := time.Now()
+	u := models.User{ID: 7, Username: "finance1", Role: RoleFinance, MustChangePassword: true}
+	token, err := signAccessToken(u, "jti-1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims AuthClaims
+	if err := parseClaims(token, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.Role != RoleFinance || claims.ID != "jti-1" || !claims.MustChangePassword {
+		t.Errorf("claims %+v do not match the user", claims)
+	}
+	if got := claims.ExpiresAt.Sub(now); got < settings.AccessTokenTTL-time.Second || got > settings.AccessTokenTTL {
+		t.Errorf("token lives %v, want %v", got, settings.AccessTokenTTL)
+	}
+}
+
+func TestAccessTokenAfterSecretRotation(t *testing.T) {
+	oldSecret, newSecret := strings.Repeat("o", 32), strings.Repeat("n", 32)
+	useHS256(t, oldSecret)
+	token, err := signAccessToken(models.User{ID: 1, Role: RoleAdmin}, "jti-1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useHS256(t, newSecret, oldSecret)
+	if err := parseClaims(token, &AuthClaims{}); err != nil {
+		t.Errorf("a token signed with the previous secret no longer verifies: %v", err)
+	}
+	useHS256(t, newSecret)
+	if err := parseClaims(token, &AuthClaims{}); err == nil {
+		t.Error("a token signed with a retired secret still verifies")
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 test key of RFC 6238, "12345678901234567890",
+// in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC 6238 appendix B vectors for SHA-1, cut to six digits.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, v := range rfc6238Vectors {
+		if got := totpCode(key, v.unix/totpPeriod); got != v.code {
+			t.Errorf("T=%d: code %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := verifyTOTP(rfc6238Secret, v.code, now, 0)
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("T=%d: verify = %d, %v; want step %d", v.unix, step, ok, v.unix/totpPeriod)
+		}
+	}
+	// Lower case secrets, as some apps show them, are accepted too.
+	if _, ok := verifyTOTP("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", time.Unix(59, 0), 0); !ok {
+		t.Error("a lower case secret was rejected")
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	if _, ok := verifyTOTP(rfc6238Secret, "081804", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("the code of the previous step was rejected")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "081804", now.Add(-totpPeriod*time.Second), 0); !ok {
+		t.Error("the code of the next step was rejected")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "081804", now.Add(2*totpPeriod*time.Second), 0); ok {
+		t.Error("a code two steps old was accepted")
+	}
+}
+
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step, ok := verifyTOTP(rfc6238Secret, "081804", now, 0)
+	if !ok {
+		t.Fatal("the code was rejected the first time")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "081804", now, step); ok {
+		t.Error("the same code was accepted twice")
+	}
+	// A code from the step before the last one used is a replay as well,
+	// even though it is within the allowed drift.
+	if _, ok := verifyTOTP(rfc6238Secret, "081804", now.Add(totpPeriod*time.Second), step); ok {
+		t.Error("an older code was accepted after a newer step was used")
+	}
+}
+
+func TestVerifyTOTPMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, tt := range []struct{ secret, code string }{
+		{rfc6238Secret, "28708"},
+		{rfc6238Secret, "2870820"},
+		{rfc6238Secret, "000000"},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := verifyTOTP(tt.secret, tt.code, now, 0); ok {
+			t.Errorf("secret %q code %q was accepted", tt.secret, tt.code)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("宿舍管理", "admin", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || q.Get("secret") != rfc6238Secret ||
+		q.Get("issuer") != "宿舍管理" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected URI %s", u)
+	}
+}
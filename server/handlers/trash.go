@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+const (
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// applyDeletedFilter handles the ?includeDeleted=true and ?onlyDeleted=true
+// list options, which need PermTrashRead. It answers 403 itself without it.
+func applyDeletedFilter(c *gin.Context, query *gorm.DB, column string) (*gorm.DB, bool) {
+	include := c.Query("includeDeleted") == "true"
+	only := c.Query("onlyDeleted") == "true"
+	if !include && !only {
+		return query, true
+	}
+	if u, _ := currentUser(c); !granted(u, PermTrashRead) {
+		respondError(c, http.StatusForbidden, errcode.DeletedAdminOnly)
+		return nil, false
+	}
+	query = query.Unscoped()
+	if only {
+		query = query.Where(column + " is not null")
+	}
+	return query, true
+}
+
+// loadDeleted finds a soft-deleted row by the :id parameter.
+func loadDeleted(c *gin.Context, out interface{}) bool {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return false
+	}
+	if err := db.DB.Unscoped().Where("deleted_at is not null").First(out, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotInTrash)
+		return false
+	}
+	return true
+}
+
+// untrash clears model's deleted_at.
+func untrash(tx *gorm.DB, model interface{}) error {
+	return tx.Unscoped().Model(model).Updates(map[string]interface{}{
+		"deleted_at": nil,
+		"version":    gorm.Expr("version + 1"),
+	}).Error
+}
+
+func restoreRow(c *gin.Context, model interface{}, entity string, id uint, before, after interface{}) {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := untrash(tx, model); err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditRestore, entity, id, before, after)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.RestoreFailed)
+		return
+	}
+	c.JSON(http.StatusOK, after)
+}
+
+func RestoreBuilding(c *gin.Context) {
+	var b models.ApartmentBuilding
+	if !loadDeleted(c, &b) || !requireBuildings(c, b.ID) {
+		return
+	}
+	before := b
+	b.DeletedAt = gorm.DeletedAt{}
+	restoreRow(c, &b, entityBuilding, b.ID, before, b)
+}
+
+func RestoreRoom(c *gin.Context) {
+	var r models.DormRoom
+	if !loadDeleted(c, &r) || !requireBuildings(c, r.BuildingID) {
+		return
+	}
+	var b models.ApartmentBuilding
+	if err := db.DB.First(&b, r.BuildingID).Error; err != nil {
+		respondError(c, http.StatusBadRequest, errcode.BuildingDeleted)
+		return
+	}
+	before := r
+	r.DeletedAt = gorm.DeletedAt{}
+	restoreRow(c, &r, entityRoom, r.ID, before, r)
+}
+
+func RestoreStudent(c *gin.Context) {
+	var s models.Student
+	if !loadDeleted(c, &s) || !requireBuildings(c, s.BuildingID) {
+		return
+	}
+	if s.RoomID != 0 {
+		var r models.DormRoom
+		if err := db.DB.First(&r, s.RoomID).Error; err != nil {
+			respondError(c, http.StatusBadRequest, errcode.RoomDeleted)
+			return
+		}
+	}
+	day, ok := moveDate(c)
+	if !ok {
+		return
+	}
+	before := s
+	s.DeletedAt = gorm.DeletedAt{}
+	// The student moves back in on day, so bill the stay like a check-in.
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setMoveDate(tx, day); err != nil {
+			return err
+		}
+		if err := untrash(tx, &s); err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditRestore, entityStudent, s.ID, before, s); err != nil {
+			return err
+		}
+		return rebillStudent(tx, c, s.ID, day)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.RestoreFailed)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// purgeTrash permanently removes rows that have been in the trash longer
+// than the retention period. Children go first; a row that is still
+// referenced stays until its dependents are purged too. Each removal is
+// audited with the row as it was.
+func purgeTrash(retention time.Duration) {
+	cutoff := time.Now().Add(-retention)
+	for _, kind := range []struct {
+		entity string
+		newRow func() interface{}
+	}{
+		{entityStudent, func() interface{} { return &models.Student{} }},
+		{entityRoom, func() interface{} { return &models.DormRoom{} }},
+		{entityBuilding, func() interface{} { return &models.ApartmentBuilding{} }},
+	} {
+		var ids []uint
+		if err := db.DB.Unscoped().Model(kind.newRow()).Where("deleted_at < ?", cutoff).Pluck("id", &ids).Error; err != nil {
+			log.Println("purge trash error", err)
+			continue
+		}
+		purged := 0
+		for _, id := range ids {
+			err := db.DB.Transaction(func(tx *gorm.DB) error {
+				row := kind.newRow()
+				if err := tx.Unscoped().First(row, id).Error; err != nil {
+					return err
+				}
+				if err := tx.Unscoped().Delete(row).Error; err != nil {
+					return err
+				}
+				return writeAudit(tx, nil, auditPurge, kind.entity, id, row, nil)
+			})
+			if err != nil {
+				log.Printf("purge trash: keep %s %d: %v", kind.entity, id, err)
+				continue
+			}
+			purged++
+		}
+		if purged > 0 {
+			log.Printf("purge trash: removed %d %s rows", purged, kind.entity)
+		}
+	}
+}
+
+func StartTrashPurger() {
+	retention := settings.TrashRetention
+	go func() {
+		purgeTrash(retention)
+		for range time.Tick(24 * time.Hour) {
+			purgeTrash(retention)
+		}
+	}()
+}
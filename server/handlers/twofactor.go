@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"dormsystem/db"
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+const (
+	recoveryCodeCount     = 10
+	loginChallengeTTL     = 5 * time.Minute
+	loginChallengeRetries = 5
+)
+
+var errInvalidSecondFactor = errors.New("invalid second factor")
+
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+	ExpiresIn         int64  `json:"expiresIn"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+	Password     string `json:"password"`
+}
+
+type TOTPEnableResponse struct {
+	LoginResponse
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func requiresTOTP(role string) bool {
+	for _, r := range settings.TOTPRequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func newLoginChallenge(u models.User) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ch := models.LoginChallenge{
+		UserID:    u.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	}
+	if err := db.DB.Create(&ch).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// generateRecoveryCodes replaces all recovery codes of a user and returns the
+// new plain codes, which are shown only once.
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := newTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(raw[:5] + "-" + raw[5:10])
+		if err := tx.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashToken(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code for u and consumes it.
+func checkSecondFactor(tx *gorm.DB, u *models.User, code, recoveryCode string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code != "" {
+		step, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		// The condition makes concurrent use of the same code fail.
+		res := tx.Model(&models.User{}).
+			Where("id = ? and totp_last_step < ?", u.ID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		u.TOTPLastStep = step
+		return res.RowsAffected == 1, nil
+	}
+	recoveryCode = strings.ToLower(strings.TrimSpace(recoveryCode))
+	if recoveryCode == "" {
+		return false, nil
+	}
+	res := tx.Model(&models.RecoveryCode{}).
+		Where("user_id = ? and code_hash = ? and used_at is null", u.ID, hashToken(recoveryCode)).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		log.Printf("recovery code used by %q", u.Username)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func VerifyLoginChallenge(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.ChallengeToken == "" {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest)
+		return
+	}
+	var ch models.LoginChallenge
+	if err := db.DB.Where("token_hash = ?", hashToken(req.ChallengeToken)).First(&ch).Error; err != nil ||
+		time.Now().After(ch.ExpiresAt) || ch.Attempts >= loginChallengeRetries {
+		respondError(c, http.StatusUnauthorized, errcode.ChallengeExpired)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, ch.UserID).Error; err != nil {
+		respondError(c, http.StatusUnauthorized, errcode.ChallengeExpired)
+		return
+	}
+	if u.LockedUntil != nil && time.Now().Before(*u.LockedUntil) {
+		respondError(c, http.StatusLocked, errcode.AccountLocked)
+		return
+	}
+	ok, err := checkSecondFactor(db.DB, &u, req.Code, req.RecoveryCode)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.LoginFailed)
+		return
+	}
+	if !ok {
+		db.DB.Model(&ch).Update("attempts", gorm.Expr("attempts + 1"))
+		recordLoginFailure(c, u)
+		respondError(c, http.StatusUnauthorized, errcode.InvalidTOTPCode)
+		return
+	}
+	db.DB.Delete(&ch)
+	finishLogin(c, u)
+}
+
+func SetupTOTP(c *gin.Context) {
+	me, _ := currentUser(c)
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if u.TOTPEnabled {
+		respondError(c, http.StatusConflict, errcode.TOTPAlreadyEnabled)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.KeyGenerationFailed)
+		return
+	}
+	before := u
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		u.TOTPSecret = secret
+		u.TOTPLastStep = 0
+		if err := tx.Model(&u).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, u)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, TOTPSetupResponse{
+		Secret: secret,
+		URI:    totpURI(settings.TOTPIssuer, u.Username, secret),
+	})
+}
+
+// EnableTOTP confirms the secret from SetupTOTP with a first code. All other
+// sessions are ended and a new one is returned with the recovery codes.
+func EnableTOTP(c *gin.Context) {
+	me, _ := currentUser(c)
+	var req TOTPCodeRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if u.TOTPEnabled {
+		respondError(c, http.StatusConflict, errcode.TOTPAlreadyEnabled)
+		return
+	}
+	if u.TOTPSecret == "" {
+		respondError(c, http.StatusBadRequest, errcode.TOTPSetupRequired)
+		return
+	}
+	step, ok := verifyTOTP(u.TOTPSecret, strings.TrimSpace(req.Code), time.Now(), 0)
+	if !ok {
+		respondError(c, http.StatusBadRequest, errcode.InvalidTOTPCode)
+		return
+	}
+	var resp TOTPEnableResponse
+	before := u
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		u.TOTPEnabled = true
+		u.TOTPLastStep = step
+		if err := tx.Model(&u).Select("totp_enabled", "totp_last_step").Updates(&u).Error; err != nil {
+			return err
+		}
+		codes, err := generateRecoveryCodes(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, u.ID); err != nil {
+			return err
+		}
+		if err := writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, u); err != nil {
+			return err
+		}
+		resp.RecoveryCodes = codes
+		resp.LoginResponse, err = issueSession(tx, u)
+		return err
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	log.Printf("two-factor authentication enabled for %q", u.Username)
+	c.JSON(http.StatusOK, resp)
+}
+
+func DisableTOTP(c *gin.Context) {
+	me, _ := currentUser(c)
+	if requiresTOTP(me.Role) {
+		respondError(c, http.StatusForbidden, errcode.TOTPRequiredForRole)
+		return
+	}
+	var req TOTPCodeRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !u.TOTPEnabled {
+		respondError(c, http.StatusBadRequest, errcode.TOTPNotEnabled)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.WrongPassword)
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		ok, err := checkSecondFactor(tx, &u, req.Code, req.RecoveryCode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		if err := clearTOTP(tx, u.ID); err != nil {
+			return err
+		}
+		after := u
+		after.TOTPEnabled = false
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, u, after)
+	})
+	if err == errInvalidSecondFactor {
+		respondError(c, http.StatusBadRequest, errcode.InvalidTOTPCode)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	log.Printf("two-factor authentication disabled by %q", u.Username)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	me, _ := currentUser(c)
+	var req TOTPCodeRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, me.ID).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	if !u.TOTPEnabled {
+		respondError(c, http.StatusBadRequest, errcode.TOTPNotEnabled)
+		return
+	}
+	var codes []string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		ok, err := checkSecondFactor(tx, &u, req.Code, "")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		codes, err = generateRecoveryCodes(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditRecoveryCodes, entityUser, u.ID, nil, nil)
+	})
+	if err == errInvalidSecondFactor {
+		respondError(c, http.StatusBadRequest, errcode.InvalidTOTPCode)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// ResetUserTOTP lets an admin remove 2FA from an account whose device and
+// recovery codes are lost. The user has to enroll again if their role
+// requires it.
+func ResetUserTOTP(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := clearTOTP(tx, u.ID); err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, u.ID); err != nil {
+			return err
+		}
+		after := u
+		after.TOTPEnabled = false
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, u, after)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
+		return
+	}
+	me, _ := currentUser(c)
+	log.Printf("two-factor authentication of %q reset by %q", u.Username, me.Username)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func clearTOTP(tx *gorm.DB, userID uint) error {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
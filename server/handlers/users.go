@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 
 	"dormsystem/db"
+	"dormsystem/errcode"
 	"dormsystem/models"
+	"dormsystem/validation"
 )
 
 type UserRequest struct {
@@ -16,6 +21,33 @@ type UserRequest struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
 	Role     string `json:"role"`
+	// ServiceAccount is only read on create.
+	ServiceAccount bool `json:"serviceAccount"`
+}
+
+// errLastAdmin is returned when a change would leave no admin who can sign
+// in.
+var errLastAdmin = errors.New("last admin")
+
+// checkOtherAdmins fails with errLastAdmin unless an admin other than u can
+// still sign in. Service accounts do not count. It locks the admins so that
+// two requests cannot each remove one of the last two.
+func checkOtherAdmins(tx *gorm.DB, u models.User) error {
+	if u.Role != RoleAdmin || u.ServiceAccount {
+		return nil
+	}
+	var ids []uint
+	err := tx.Raw("select id from users where role = ? and not service_account order by id for update", RoleAdmin).
+		Scan(&ids).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id != u.ID {
+			return nil
+		}
+	}
+	return errLastAdmin
 }
 
 func ListUsers(c *gin.Context) {
@@ -40,23 +72,50 @@ func ListUsers(c *gin.Context) {
 
 func CreateUser(c *gin.Context) {
 	var req UserRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码处理失败"})
+	if invalid(c, validation.User(req.Username, req.Name, req.Role, IsKnownRole)) {
 		return
 	}
 	u := models.User{
-		Username:     req.Username,
-		Name:         req.Name,
-		PasswordHash: string(hash),
-		Role:         req.Role,
+		Username:       req.Username,
+		Name:           req.Name,
+		Role:           req.Role,
+		ServiceAccount: req.ServiceAccount,
+		Version:        1,
+	}
+	if req.ServiceAccount {
+		if req.Password != "" {
+			respondError(c, http.StatusBadRequest, errcode.ServiceAccountPassword)
+			return
+		}
+		// Not a valid bcrypt hash, so no password ever matches.
+		u.PasswordHash = "!"
+	} else {
+		if req.Password == "" {
+			respondError(c, http.StatusBadRequest, errcode.PasswordRequired)
+			return
+		}
+		if perr := checkPasswordPolicy(req.Username, req.Password); perr != nil {
+			respondError(c, http.StatusBadRequest, perr.Code, perr.Args...)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, errcode.PasswordHashFailed)
+			return
+		}
+		u.PasswordHash = string(hash)
 	}
-	if err := db.DB.Create(&u).Error; err != nil {
-		respondDBError(c, err, "创建失败")
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&u).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditCreate, entityUser, u.ID, nil, u)
+	})
+	if err != nil {
+		respondDBError(c, err, errcode.CreateFailed)
 		return
 	}
 	c.JSON(http.StatusOK, u)
@@ -66,47 +125,220 @@ func UpdateUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
 		return
 	}
 	var u models.User
 	if err := db.DB.First(&u, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		respondError(c, http.StatusNotFound, errcode.NotFound)
 		return
 	}
 	var req UserRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据不合法"})
+	if !bindJSON(c, &req) {
 		return
 	}
+	if invalid(c, validation.User(req.Username, req.Name, req.Role, IsKnownRole)) {
+		return
+	}
+	if u.ServiceAccount && req.Password != "" {
+		respondError(c, http.StatusBadRequest, errcode.ServiceAccountPassword)
+		return
+	}
+	if !checkIfMatch(c, u.Version, u) {
+		return
+	}
+	revoke := u.Username != req.Username || u.Role != req.Role || req.Password != ""
+	before := u
+	version := u.Version
+	u.Version++
 	u.Username = req.Username
 	u.Name = req.Name
 	u.Role = req.Role
 	if req.Password != "" {
+		if perr := checkPasswordPolicy(req.Username, req.Password); perr != nil {
+			respondError(c, http.StatusBadRequest, perr.Code, perr.Args...)
+			return
+		}
 		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "密码处理失败"})
+			respondError(c, http.StatusInternalServerError, errcode.PasswordHashFailed)
 			return
 		}
 		u.PasswordHash = string(hash)
 	}
-	if err := db.DB.Save(&u).Error; err != nil {
-		respondDBError(c, err, "更新失败")
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if u.Role != RoleAdmin {
+			if err := checkOtherAdmins(tx, before); err != nil {
+				return err
+			}
+		}
+		if err := saveVersioned(tx, &u, version, "username", "name", "role", "password_hash"); err != nil {
+			return err
+		}
+		if revoke {
+			if err := revokeUserSessions(tx, u.ID); err != nil {
+				return err
+			}
+		}
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, u)
+	})
+	if errors.Is(err, errLastAdmin) {
+		respondError(c, http.StatusConflict, errcode.LastAdmin)
+		return
+	}
+	if errors.Is(err, errStaleVersion) {
+		respondStaleUser(c, u.ID)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
 		return
 	}
+	setETag(c, u.Version)
 	c.JSON(http.StatusOK, u)
 }
 
+// respondStaleUser answers 412 with the account as it is now.
+func respondStaleUser(c *gin.Context, id uint) {
+	var cur models.User
+	if err := db.DB.First(&cur, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	respondStale(c, cur.Version, cur)
+}
+
 func DeleteUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的ID"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
 		return
 	}
-	if err := db.DB.Delete(&models.User{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkOtherAdmins(tx, u); err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, u.ID); err != nil {
+			return err
+		}
+		if err := tx.Delete(&u).Error; err != nil {
+			return err
+		}
+		return writeAudit(tx, c, auditDelete, entityUser, u.ID, u, nil)
+	})
+	if errors.Is(err, errLastAdmin) {
+		respondError(c, http.StatusConflict, errcode.LastAdmin)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.DeleteFailed)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+type UserBuildingsRequest struct {
+	BuildingIDs []uint `json:"buildingIDs"`
+}
+
+func GetUserBuildings(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	ids := []uint{}
+	if err := db.DB.Model(&models.UserBuilding{}).Where("user_id = ?", u.ID).Pluck("building_id", &ids).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+		return
+	}
+	// The assignment is versioned with the user, so PUT takes this ETag.
+	respondVersioned(c, u.Version, UserBuildingsRequest{BuildingIDs: ids})
+}
+
+// SetUserBuildings replaces the buildings assigned to a manager.
+func SetUserBuildings(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidID)
+		return
+	}
+	var u models.User
+	if err := db.DB.First(&u, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound)
+		return
+	}
+	var req UserBuildingsRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if u.Role != RoleManager && len(req.BuildingIDs) > 0 {
+		respondError(c, http.StatusBadRequest, errcode.BuildingsManagerOnly)
+		return
+	}
+	if !checkIfMatch(c, u.Version, u) {
+		return
+	}
+	var count int64
+	if len(req.BuildingIDs) > 0 {
+		if err := db.DB.Model(&models.ApartmentBuilding{}).Where("id in ?", req.BuildingIDs).Count(&count).Error; err != nil {
+			respondError(c, http.StatusInternalServerError, errcode.QueryFailed)
+			return
+		}
+	}
+	seen := map[uint]bool{}
+	for _, bid := range req.BuildingIDs {
+		seen[bid] = true
+	}
+	if int(count) != len(seen) {
+		respondError(c, http.StatusBadRequest, errcode.BuildingNotFound)
+		return
+	}
+	before := UserBuildingsRequest{BuildingIDs: []uint{}}
+	after := UserBuildingsRequest{BuildingIDs: []uint{}}
+	version := u.Version
+	u.Version++
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveVersioned(tx, &u, version, "version"); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.UserBuilding{}).Where("user_id = ?", u.ID).
+			Order("building_id").Pluck("building_id", &before.BuildingIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", u.ID).Delete(&models.UserBuilding{}).Error; err != nil {
+			return err
+		}
+		for bid := range seen {
+			if err := tx.Create(&models.UserBuilding{UserID: u.ID, BuildingID: bid}).Error; err != nil {
+				return err
+			}
+			after.BuildingIDs = append(after.BuildingIDs, bid)
+		}
+		sort.Slice(after.BuildingIDs, func(i, j int) bool { return after.BuildingIDs[i] < after.BuildingIDs[j] })
+		return writeAudit(tx, c, auditUpdate, entityUser, u.ID, before, after)
+	})
+	if errors.Is(err, errStaleVersion) {
+		respondStaleUser(c, u.ID)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err, errcode.UpdateFailed)
 		return
 	}
+	setETag(c, u.Version)
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"dormsystem/errcode"
+	"dormsystem/validation"
+)
+
+// bindJSON decodes the request body into obj and answers 400 with field
+// errors when it cannot.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	if err := c.ShouldBindJSON(obj); err != nil {
+		invalid(c, validation.FromBindError(err))
+		return false
+	}
+	return true
+}
+
+// invalid answers 400 with the field errors and reports whether there were
+// any.
+func invalid(c *gin.Context, errs validation.Errors) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	respondErrorWith(c, http.StatusBadRequest, errcode.InvalidRequest, gin.H{"fields": errs.Localize(requestLang(c))})
+	return true
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"dormsystem/config"
 	"dormsystem/db"
 	"dormsystem/handlers"
-	"dormsystem/models"
 	"dormsystem/router"
 )
 
 func main() {
+	// genkey needs neither the database nor valid key settings.
+	if len(os.Args) > 1 && os.Args[1] == "genkey" {
+		os.Exit(runGenKey(os.Args[2:]))
+	}
 	cfg := config.Load()
-	db.Init(cfg.DBUrl,
-		&models.ApartmentBuilding{},
-		&models.DormRoom{},
-		&models.Student{},
-		&models.Payment{},
-		&models.User{},
-	)
+	db.Init(cfg.DBUrl)
+	// migrate must run before the schema check below, and needs neither
+	// the JWT keys nor the other settings of the server.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	handlers.Configure(cfg)
+	if err := handlers.InitSigningKeys(cfg); err != nil {
+		log.Fatal("load JWT keys: ", err)
+	}
+	if err := db.CheckMigrations(); err != nil {
+		log.Fatal("database schema: ", err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	handlers.InitAuthData()
+	handlers.StartTrashPurger()
 	r := router.SetupRouter()
 	r.Run(cfg.HTTPPort)
 }
-
@@ -1,39 +1,51 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type ApartmentBuilding struct {
-	ID         uint      `gorm:"primaryKey" json:"id"`
-	BuildingNo string    `gorm:"uniqueIndex;size:20;not null" json:"buildingNo"`
-	FloorCount int       `gorm:"not null" json:"floorCount"`
-	RoomCount  int       `gorm:"not null" json:"roomCount"`
-	StartedAt  time.Time `gorm:"not null;type:date" json:"startedAt"`
-	Rooms      []DormRoom `gorm:"foreignKey:BuildingID;references:ID" json:"-"`
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	BuildingNo string         `gorm:"uniqueIndex:idx_buildings_building_no_active,where:deleted_at IS NULL;size:20;not null" json:"buildingNo"`
+	FloorCount int            `gorm:"not null" json:"floorCount"`
+	RoomCount  int            `gorm:"not null" json:"roomCount"`
+	StartedAt  time.Time      `gorm:"not null;type:date" json:"startedAt"`
+	Version    int            `gorm:"not null;default:1" json:"version"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"deletedAt,omitempty"`
+	Rooms      []DormRoom     `gorm:"foreignKey:BuildingID;references:ID" json:"-"`
 }
 
 type DormRoom struct {
-	ID         uint    `gorm:"primaryKey" json:"id"`
-	RoomNo     string  `gorm:"size:20;not null" json:"roomNo"`
-	Capacity   int     `gorm:"not null" json:"capacity"`
-	Fee        float64 `json:"fee"`
-	Phone      string  `gorm:"size:20" json:"phone"`
-	BuildingID uint    `gorm:"not null;index" json:"buildingID"`
+	ID       uint    `gorm:"primaryKey" json:"id"`
+	RoomNo   string  `gorm:"size:20;not null" json:"roomNo"`
+	Capacity int     `gorm:"not null" json:"capacity"`
+	Fee      float64 `json:"fee"`
+	Phone    string  `gorm:"size:20" json:"phone"`
+	// RoomType groups rooms that share a fee schedule, e.g. 四人间.
+	RoomType   string            `gorm:"size:20" json:"roomType"`
+	BuildingID uint              `gorm:"not null;index" json:"buildingID"`
+	Version    int               `gorm:"not null;default:1" json:"version"`
+	DeletedAt  gorm.DeletedAt    `gorm:"index" json:"deletedAt,omitempty"`
 	Building   ApartmentBuilding `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;" json:"-"`
 	Students   []Student         `gorm:"foreignKey:RoomID;references:ID" json:"-"`
 	Payments   []Payment         `gorm:"foreignKey:RoomID;references:ID" json:"-"`
 }
 
 type Student struct {
-	ID         uint   `gorm:"primaryKey" json:"id"`
-	StudentNo  string `gorm:"uniqueIndex;size:20;not null" json:"studentNo"`
-	Name       string `gorm:"size:50;not null" json:"name"`
-	Gender     string `gorm:"size:10" json:"gender"`
-	Ethnicity  string `gorm:"size:20" json:"ethnicity"`
-	Major      string `gorm:"size:100" json:"major"`
-	ClassName  string `gorm:"size:50" json:"className"`
-	Phone      string `gorm:"size:20" json:"phone"`
-	BuildingID uint   `gorm:"index" json:"buildingID"`
-	RoomID     uint   `gorm:"index" json:"roomID"`
+	ID         uint              `gorm:"primaryKey" json:"id"`
+	StudentNo  string            `gorm:"uniqueIndex:idx_students_student_no_active,where:deleted_at IS NULL;size:20;not null" json:"studentNo"`
+	Name       string            `gorm:"size:50;not null" json:"name"`
+	Gender     string            `gorm:"size:10" json:"gender"`
+	Ethnicity  string            `gorm:"size:20" json:"ethnicity"`
+	Major      string            `gorm:"size:100" json:"major"`
+	ClassName  string            `gorm:"size:50" json:"className"`
+	Phone      string            `gorm:"size:20" json:"phone"`
+	BuildingID uint              `gorm:"index" json:"buildingID"`
+	RoomID     uint              `gorm:"index" json:"roomID"`
+	Version    int               `gorm:"not null;default:1" json:"version"`
+	DeletedAt  gorm.DeletedAt    `gorm:"index" json:"deletedAt,omitempty"`
 	Building   ApartmentBuilding `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
 	Room       DormRoom          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
 	Payments   []Payment         `json:"-"`
@@ -41,23 +53,259 @@ type Student struct {
 
 type Payment struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
-	PaymentNo   string    `gorm:"uniqueIndex;size:50;not null" json:"paymentNo"`
+	PaymentNo   string    `gorm:"uniqueIndex:idx_payments_payment_no_active,where:deleted_at IS NULL;size:50;not null" json:"paymentNo"`
 	BuildingID  uint      `gorm:"not null;index" json:"buildingID"`
 	RoomID      uint      `gorm:"not null;index" json:"roomID"`
 	StudentID   uint      `gorm:"index" json:"studentID"`
 	PaidAt      time.Time `gorm:"not null;type:date" json:"paidAt"`
 	PaymentType string    `gorm:"size:50;not null" json:"paymentType"`
 	Amount      float64   `gorm:"not null" json:"amount"`
-	Building    ApartmentBuilding `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;" json:"-"`
-	Room        DormRoom          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;" json:"-"`
-	Student     Student           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+	// Status is posted, voided or reversed. Posted payments are never edited;
+	// a correction voids them or posts a negative entry with ReversalOfID set.
+	Status       string     `gorm:"size:20;not null;default:posted" json:"status"`
+	Reason       string     `gorm:"size:200" json:"reason"`
+	VoidedAt     *time.Time `json:"voidedAt"`
+	ReversalOfID *uint      `gorm:"uniqueIndex" json:"reversalOfID"`
+	// BillID is the bill the payment settles, if any.
+	BillID *uint `gorm:"index" json:"billID"`
+	// TermID is the term the payment counts towards: its bill's, or the one
+	// it was paid in.
+	TermID    *uint             `gorm:"index" json:"termID"`
+	Version   int               `gorm:"not null;default:1" json:"version"`
+	DeletedAt gorm.DeletedAt    `gorm:"index" json:"deletedAt,omitempty"`
+	Building  ApartmentBuilding `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;" json:"-"`
+	Room      DormRoom          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;" json:"-"`
+	Student   Student           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
 }
 
+const (
+	PaymentPosted   = "posted"
+	PaymentVoided   = "voided"
+	PaymentReversed = "reversed"
+)
+
+const (
+	FeeAccommodation = "住宿费"
+	FeeUtilities     = "水电费"
+	FeeDeposit       = "押金"
+)
+
+// FeeTypes are the fee items that are charged and paid.
+var FeeTypes = []string{FeeAccommodation, FeeUtilities, FeeDeposit}
+
+// DepositTransaction takes money out of a student's deposit: a refund,
+// usually at checkout, or a deduction for one damaged item. Deposits are
+// received as payments of type FeeDeposit. Like payments, transactions are
+// never edited, only voided.
+type DepositTransaction struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	StudentID  uint   `gorm:"not null;index" json:"studentID"`
+	BuildingID uint   `gorm:"not null;index" json:"buildingID"`
+	RoomID     uint   `gorm:"not null;index" json:"roomID"`
+	Kind       string `gorm:"size:20;not null" json:"kind"`
+	// Description says what a deduction is for; on a refund it is a note.
+	Description string     `gorm:"size:100" json:"description"`
+	Amount      float64    `gorm:"not null" json:"amount"`
+	OccurredAt  time.Time  `gorm:"not null;type:date" json:"occurredAt"`
+	Status      string     `gorm:"size:20;not null;default:posted" json:"status"`
+	Reason      string     `gorm:"size:200" json:"reason"`
+	VoidedAt    *time.Time `json:"voidedAt"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+const (
+	DepositRefund    = "refund"
+	DepositDeduction = "deduction"
+)
+
+// StudentStay is one period a student lived in a room, from StartDate up to
+// but not including EndDate; the current stay has no EndDate. Stays are
+// written by a trigger whenever a student's room changes.
+type StudentStay struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	StudentID uint       `gorm:"not null;index" json:"studentID"`
+	RoomID    uint       `gorm:"not null;index" json:"roomID"`
+	StartDate time.Time  `gorm:"not null;type:date" json:"startDate"`
+	EndDate   *time.Time `gorm:"type:date" json:"endDate"`
+}
+
+// Term is a semester that fees are charged and paid for. Closed terms take
+// no new schedules or bills; payments against their bills are still taken.
+type Term struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Name      string     `gorm:"size:20;not null;uniqueIndex:idx_terms_name" json:"name"`
+	StartDate time.Time  `gorm:"not null;type:date" json:"startDate"`
+	EndDate   time.Time  `gorm:"not null;type:date" json:"endDate"`
+	Status    string     `gorm:"size:20;not null;default:open" json:"status"`
+	ClosedAt  *time.Time `json:"closedAt"`
+	Version   int        `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+const (
+	TermOpen   = "open"
+	TermClosed = "closed"
+)
+
+// FeeSchedule is what one fee item costs per occupant in a term. It targets
+// a room, a room type (optionally within one building) or a whole building;
+// the most specific schedule wins.
+type FeeSchedule struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TermID     uint      `gorm:"not null" json:"termID"`
+	FeeType    string    `gorm:"size:50;not null" json:"feeType"`
+	BuildingID *uint     `gorm:"index" json:"buildingID"`
+	RoomID     *uint     `gorm:"index" json:"roomID"`
+	RoomType   string    `gorm:"size:20" json:"roomType"`
+	Amount     float64   `gorm:"not null" json:"amount"`
+	Version    int       `gorm:"not null;default:1" json:"version"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// Bill is one fee item charged to one occupant of one room for a term.
+// Accommodation is prorated from FullAmount, the price of the whole term,
+// by the student's days in the room; other items are charged in full.
+// A bill never changes once issued; BillAdjustments credit or charge it
+// afterwards. DueAmount, PaidAmount, Settled and OverpaidAmount take the
+// adjustments and the payments settling the bill into account and are only
+// filled when it is read from v_bills.
+type Bill struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	TermID         uint      `gorm:"not null;index" json:"termID"`
+	FeeType        string    `gorm:"size:50;not null" json:"feeType"`
+	StudentID      uint      `gorm:"not null;index" json:"studentID"`
+	BuildingID     uint      `gorm:"not null;index" json:"buildingID"`
+	RoomID         uint      `gorm:"not null;index" json:"roomID"`
+	FeeScheduleID  *uint     `json:"feeScheduleID"`
+	Amount         float64   `gorm:"not null" json:"amount"`
+	FullAmount     float64   `gorm:"not null" json:"fullAmount"`
+	DueAmount      float64   `gorm:"->" json:"dueAmount"`
+	PaidAmount     float64   `gorm:"->" json:"paidAmount"`
+	Settled        bool      `gorm:"->" json:"settled"`
+	OverpaidAmount float64   `gorm:"->" json:"overpaidAmount"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// BillAdjustment changes what is owed on a bill after it was issued.
+// Negative amounts are credits.
+type BillAdjustment struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	BillID    uint      `gorm:"not null;index" json:"billID"`
+	Amount    float64   `gorm:"not null" json:"amount"`
+	Reason    string    `gorm:"size:50;not null" json:"reason"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// AdjustProration re-prorates accommodation after a move.
+const AdjustProration = "proration"
+
 type User struct {
-	ID           uint      `gorm:"primaryKey" json:"id"`
-	Username     string    `gorm:"uniqueIndex;size:50;not null" json:"username"`
-	Name         string    `gorm:"size:50;not null" json:"name"`
-	PasswordHash string    `gorm:"size:200;not null" json:"-"`
-	Role         string    `gorm:"size:20;not null" json:"role"`
-	CreatedAt    time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	ID                 uint       `gorm:"primaryKey" json:"id"`
+	Username           string     `gorm:"uniqueIndex;size:50;not null" json:"username"`
+	Name               string     `gorm:"size:50;not null" json:"name"`
+	PasswordHash       string     `gorm:"size:200;not null" json:"-"`
+	Role               string     `gorm:"size:20;not null" json:"role"`
+	MustChangePassword bool       `gorm:"not null;default:false" json:"mustChangePassword"`
+	FailedLoginCount   int        `gorm:"not null;default:0" json:"failedLoginCount"`
+	LockedUntil        *time.Time `json:"lockedUntil"`
+	TOTPSecret         string     `gorm:"size:64" json:"-"`
+	TOTPEnabled        bool       `gorm:"not null;default:false" json:"totpEnabled"`
+	TOTPLastStep       int64      `gorm:"not null;default:0" json:"-"`
+	// ServiceAccount users cannot log in and authenticate with API keys only.
+	ServiceAccount bool `gorm:"not null;default:false" json:"serviceAccount"`
+	// Version changes with the account fields and the building assignment;
+	// logins, lockouts and 2FA changes leave it alone.
+	Version   int       `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// RefreshToken is one login session. Only the SHA-256 of the token is stored.
+// AccessJTI is the jti of the latest access token issued for the session so
+// it can be denylisted when the session is revoked.
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"userID"`
+	TokenHash string     `gorm:"uniqueIndex;size:64;not null" json:"-"`
+	AccessJTI string     `gorm:"size:64;index" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	User      User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// RevokedToken is the access token denylist, kept until the token expires.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;size:64" json:"jti"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expiresAt"`
+}
+
+// UserBuilding assigns a building to a manager account.
+type UserBuilding struct {
+	UserID     uint              `gorm:"primaryKey" json:"userID"`
+	BuildingID uint              `gorm:"primaryKey;index" json:"buildingID"`
+	User       User              `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	Building   ApartmentBuilding `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// RecoveryCode is a one-time 2FA fallback code, stored as SHA-256.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"userID"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	User      User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// LoginChallenge is issued after a correct password when the account has 2FA
+// enabled; it is exchanged for a session together with a TOTP code.
+type LoginChallenge struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"userID"`
+	TokenHash string    `gorm:"uniqueIndex;size:64;not null" json:"-"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"`
+	ExpiresAt time.Time `gorm:"not null" json:"expiresAt"`
+	User      User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// APIKey is a machine credential of a service account. Only the SHA-256 of
+// the key is stored; Prefix is kept in clear so a key can be recognised.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"userID"`
+	Name       string     `gorm:"size:100;not null" json:"name"`
+	Prefix     string     `gorm:"size:20;not null" json:"prefix"`
+	KeyHash    string     `gorm:"uniqueIndex;size:64;not null" json:"-"`
+	Scopes     string     `gorm:"size:500;not null" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	User       User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// JSONText is raw JSON kept in a jsonb column and emitted as-is.
+type JSONText string
+
+func (j JSONText) MarshalJSON() ([]byte, error) {
+	if j == "" {
+		return []byte("null"), nil
+	}
+	return []byte(j), nil
+}
+
+// AuditLog records one change to a business record. Before is empty for
+// creates and After for deletes.
+type AuditLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	UserID     uint      `gorm:"index" json:"userID"`
+	Username   string    `gorm:"size:50" json:"username"`
+	Action     string    `gorm:"size:20;not null;index" json:"action"`
+	EntityType string    `gorm:"size:30;not null;index:idx_audit_entity" json:"entityType"`
+	EntityID   uint      `gorm:"index:idx_audit_entity" json:"entityID"`
+	Before     *JSONText `gorm:"type:jsonb" json:"before"`
+	After      *JSONText `gorm:"type:jsonb" json:"after"`
+	IP         string    `gorm:"size:64" json:"ip"`
+	RequestID  string    `gorm:"size:64;index" json:"requestID"`
+	CreatedAt  time.Time `gorm:"autoCreateTime;index" json:"createdAt"`
 }
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"dormsystem/config"
+	"dormsystem/errcode"
+)
+
+func corsMiddleware(cfg config.Config) gin.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, o := range cfg.CORSAllowedOrigins {
+		allowed[o] = true
+	}
+	credentials := map[string]bool{}
+	for _, o := range cfg.CORSCredentialOrigins {
+		credentials[o] = true
+	}
+	methods := strings.Join(cfg.CORSAllowedMethods, ", ")
+	headers := strings.Join(cfg.CORSAllowedHeaders, ", ")
+	exposed := strings.Join(cfg.CORSExposedHeaders, ", ")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		c.Writer.Header().Add("Vary", "Origin")
+		if origin != "" {
+			switch {
+			case allowed[origin]:
+				c.Header("Access-Control-Allow-Origin", origin)
+				if credentials[origin] {
+					c.Header("Access-Control-Allow-Credentials", "true")
+				}
+			case allowed["*"]:
+				// A wildcard origin can never be combined with credentials.
+				c.Header("Access-Control-Allow-Origin", "*")
+			}
+			if exposed != "" {
+				c.Header("Access-Control-Expose-Headers", exposed)
+			}
+		}
+		if c.Request.Method == "OPTIONS" {
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// securityHeaders sets the browser hardening headers. API responses get a
+// CSP that forbids everything, the SPA gets the configured one.
+func securityHeaders(cfg config.Config) gin.HandlerFunc {
+	hsts := "max-age=" + strconv.Itoa(cfg.HSTSMaxAge) + "; includeSubDomains"
+	return func(c *gin.Context) {
+		h := c.Writer.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		} else {
+			h.Set("Content-Security-Policy", cfg.ContentSecurityPolicy)
+		}
+		c.Next()
+	}
+}
+
+// serveSPA serves the built frontend from dir and falls back to index.html
+// so client-side routes survive a reload.
+func serveSPA(r *gin.Engine, dir string) {
+	index := filepath.Join(dir, "index.html")
+	r.Static("/assets", filepath.Join(dir, "assets"))
+	r.NoRoute(func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet || strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.JSON(http.StatusNotFound, errcode.Body(errcode.EndpointNotFound, errcode.Lang(c.GetHeader("Accept-Language"))))
+			return
+		}
+		path := filepath.Join(dir, filepath.Clean("/"+c.Request.URL.Path))
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			c.File(path)
+			return
+		}
+		c.File(index)
+	})
+}
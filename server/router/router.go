@@ -1,47 +1,109 @@
 package router
 
 import (
+	"log"
+
 	"github.com/gin-gonic/gin"
 
+	"dormsystem/config"
 	"dormsystem/handlers"
 )
 
 func SetupRouter() *gin.Engine {
+	cfg := config.Load()
 	r := gin.Default()
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
-	r.POST("/api/login", handlers.Login)
+	// Client IPs key the login rate limit and the audit log, so only
+	// configured proxies may set them through X-Forwarded-For.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("DORM_TRUSTED_PROXIES: ", err)
+	}
+	r.Use(handlers.RequestID())
+	if cfg.SecurityHeaders {
+		r.Use(securityHeaders(cfg))
+	}
+	r.Use(corsMiddleware(cfg))
+	if cfg.WebDir != "" {
+		serveSPA(r, cfg.WebDir)
+	}
+	loginLimit := handlers.LoginRateLimit()
+	r.GET("/.well-known/jwks.json", handlers.GetJWKS)
+	r.POST("/api/login", loginLimit, handlers.Login)
+	r.POST("/api/login/2fa", loginLimit, handlers.VerifyLoginChallenge)
+	r.POST("/api/token/refresh", handlers.RefreshAccessToken)
 	api := r.Group("/api")
-	api.GET("/stats/building-occupancy", handlers.GetBuildingOccupancy)
-	api.GET("/stats/building-payments", handlers.GetBuildingPaymentSummary)
-	api.GET("/buildings", handlers.ListBuildings)
-	api.POST("/buildings", handlers.CreateBuilding)
-	api.PUT("/buildings/:id", handlers.UpdateBuilding)
-	api.DELETE("/buildings/:id", handlers.DeleteBuilding)
-	api.GET("/rooms", handlers.ListRooms)
-	api.POST("/rooms", handlers.CreateRoom)
-	api.PUT("/rooms/:id", handlers.UpdateRoom)
-	api.DELETE("/rooms/:id", handlers.DeleteRoom)
-	api.GET("/students", handlers.ListStudents)
-	api.POST("/students", handlers.CreateStudent)
-	api.PUT("/students/:id", handlers.UpdateStudent)
-	api.DELETE("/students/:id", handlers.DeleteStudent)
-	api.GET("/payments", handlers.ListPayments)
-	api.POST("/payments", handlers.CreatePayment)
-	api.PUT("/payments/:id", handlers.UpdatePayment)
-	api.DELETE("/payments/:id", handlers.DeletePayment)
-	api.GET("/users", handlers.ListUsers)
-	api.POST("/users", handlers.CreateUser)
-	api.PUT("/users/:id", handlers.UpdateUser)
-	api.DELETE("/users/:id", handlers.DeleteUser)
+	api.Use(handlers.AuthMiddleware())
+	api.POST("/logout", handlers.RejectAPIKeys(), handlers.Logout)
+	me := api.Group("/me", handlers.RejectAPIKeys())
+	me.GET("", handlers.GetMe)
+	me.PUT("", handlers.UpdateMe)
+	me.PUT("/password", handlers.ChangePassword)
+	me.POST("/2fa/setup", handlers.SetupTOTP)
+	me.POST("/2fa/enable", handlers.EnableTOTP)
+	me.POST("/2fa/disable", handlers.DisableTOTP)
+	me.POST("/2fa/recovery-codes", handlers.RegenerateRecoveryCodes)
+	api.GET("/stats/building-occupancy", handlers.RequirePermission(handlers.PermStatsRead), handlers.GetBuildingOccupancy)
+	api.GET("/stats/building-payments", handlers.RequirePermission(handlers.PermStatsRead), handlers.GetBuildingPaymentSummary)
+	api.GET("/stats/building-deposits", handlers.RequirePermission(handlers.PermStatsRead), handlers.GetBuildingDepositSummary)
+	api.GET("/buildings", handlers.RequirePermission(handlers.PermBuildingsRead), handlers.ListBuildings)
+	api.POST("/buildings", handlers.RequirePermission(handlers.PermBuildingsWrite), handlers.CreateBuilding)
+	api.GET("/buildings/:id", handlers.RequirePermission(handlers.PermBuildingsRead), handlers.GetBuilding)
+	api.PUT("/buildings/:id", handlers.RequirePermission(handlers.PermBuildingsWrite), handlers.UpdateBuilding)
+	api.DELETE("/buildings/:id", handlers.RequirePermission(handlers.PermBuildingsWrite), handlers.DeleteBuilding)
+	api.GET("/buildings/:id/dependencies", handlers.RequirePermission(handlers.PermBuildingsRead), handlers.GetBuildingDependencies)
+	api.GET("/buildings/:id/arrears", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.ListBuildingArrears)
+	api.POST("/buildings/:id/restore", handlers.RequirePermission(handlers.PermBuildingsWrite), handlers.RestoreBuilding)
+	api.GET("/rooms", handlers.RequirePermission(handlers.PermRoomsRead), handlers.ListRooms)
+	api.POST("/rooms", handlers.RequirePermission(handlers.PermRoomsWrite), handlers.CreateRoom)
+	api.GET("/rooms/lookup", handlers.RequirePermission(handlers.PermRoomsRead), handlers.LookupRoom)
+	api.GET("/rooms/:id", handlers.RequirePermission(handlers.PermRoomsRead), handlers.GetRoom)
+	api.PUT("/rooms/:id", handlers.RequirePermission(handlers.PermRoomsWrite), handlers.UpdateRoom)
+	api.DELETE("/rooms/:id", handlers.RequirePermission(handlers.PermRoomsWrite), handlers.DeleteRoom)
+	api.GET("/rooms/:id/dependencies", handlers.RequirePermission(handlers.PermRoomsRead), handlers.GetRoomDependencies)
+	api.GET("/rooms/:id/balance", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetRoomBalance)
+	api.POST("/rooms/:id/restore", handlers.RequirePermission(handlers.PermRoomsWrite), handlers.RestoreRoom)
+	api.GET("/students", handlers.RequirePermission(handlers.PermStudentsRead), handlers.ListStudents)
+	api.POST("/students", handlers.RequirePermission(handlers.PermStudentsWrite), handlers.CreateStudent)
+	api.POST("/students/import", handlers.RequirePermission(handlers.PermStudentsWrite), handlers.ImportStudents)
+	api.GET("/students/:id", handlers.RequirePermission(handlers.PermStudentsRead), handlers.GetStudent)
+	api.PUT("/students/:id", handlers.RequirePermission(handlers.PermStudentsWrite), handlers.UpdateStudent)
+	api.DELETE("/students/:id", handlers.RequirePermission(handlers.PermStudentsWrite), handlers.DeleteStudent)
+	api.GET("/students/:id/balance", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetStudentBalance)
+	api.GET("/students/:id/stays", handlers.RequirePermission(handlers.PermStudentsRead), handlers.ListStudentStays)
+	api.GET("/students/:id/deposit", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetStudentDeposit)
+	api.POST("/students/:id/deposit/refund", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.RefundDeposit)
+	api.POST("/students/:id/deposit/deductions", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.DeductDeposit)
+	api.POST("/deposit-transactions/:id/void", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.VoidDepositTransaction)
+	api.POST("/students/:id/restore", handlers.RequirePermission(handlers.PermStudentsWrite), handlers.RestoreStudent)
+	api.GET("/payments", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.ListPayments)
+	api.POST("/payments", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.CreatePayment)
+	api.GET("/payments/:id", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetPayment)
+	api.POST("/payments/:id/void", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.VoidPayment)
+	api.POST("/payments/:id/reverse", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.ReversePayment)
+	api.GET("/terms", handlers.RequirePermission(handlers.PermTermsRead), handlers.ListTerms)
+	api.POST("/terms", handlers.RequirePermission(handlers.PermTermsWrite), handlers.CreateTerm)
+	api.GET("/terms/:id", handlers.RequirePermission(handlers.PermTermsRead), handlers.GetTerm)
+	api.PUT("/terms/:id", handlers.RequirePermission(handlers.PermTermsWrite), handlers.UpdateTerm)
+	api.POST("/terms/:id/open", handlers.RequirePermission(handlers.PermTermsWrite), handlers.OpenTerm)
+	api.POST("/terms/:id/close", handlers.RequirePermission(handlers.PermTermsWrite), handlers.CloseTerm)
+	api.GET("/fee-schedules", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.ListFeeSchedules)
+	api.POST("/fee-schedules", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.CreateFeeSchedule)
+	api.GET("/fee-schedules/:id", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetFeeSchedule)
+	api.PUT("/fee-schedules/:id", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.UpdateFeeSchedule)
+	api.DELETE("/fee-schedules/:id", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.DeleteFeeSchedule)
+	api.GET("/bills", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.ListBills)
+	api.POST("/bills/run", handlers.RequirePermission(handlers.PermPaymentsWrite), handlers.RunBilling)
+	api.GET("/bills/:id", handlers.RequirePermission(handlers.PermPaymentsRead), handlers.GetBill)
+	api.GET("/users", handlers.RequirePermission(handlers.PermUsersRead), handlers.ListUsers)
+	api.POST("/users", handlers.RequirePermission(handlers.PermUsersWrite), handlers.CreateUser)
+	api.PUT("/users/:id", handlers.RequirePermission(handlers.PermUsersWrite), handlers.UpdateUser)
+	api.DELETE("/users/:id", handlers.RequirePermission(handlers.PermUsersWrite), handlers.DeleteUser)
+	api.POST("/users/:id/unlock", handlers.RequirePermission(handlers.PermUsersWrite), handlers.UnlockUser)
+	api.POST("/users/:id/2fa/reset", handlers.RequirePermission(handlers.PermUsersWrite), handlers.ResetUserTOTP)
+	api.GET("/users/:id/api-keys", handlers.RequirePermission(handlers.PermUsersRead), handlers.ListAPIKeys)
+	api.POST("/users/:id/api-keys", handlers.RequirePermission(handlers.PermUsersWrite), handlers.CreateAPIKey)
+	api.DELETE("/users/:id/api-keys/:keyID", handlers.RequirePermission(handlers.PermUsersWrite), handlers.RevokeAPIKey)
+	api.GET("/audit", handlers.RequirePermission(handlers.PermAuditRead), handlers.ListAuditLogs)
+	api.GET("/users/:id/buildings", handlers.RequirePermission(handlers.PermUsersRead), handlers.GetUserBuildings)
+	api.PUT("/users/:id/buildings", handlers.RequirePermission(handlers.PermUsersWrite), handlers.SetUserBuildings)
 	return r
 }
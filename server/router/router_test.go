@@ -0,0 +1,41 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientIP asks a router set up from the environment which client IP it
+// sees for a request from remote carrying X-Forwarded-For.
+func clientIP(t *testing.T, remote, forwarded string) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := SetupRouter()
+	r.GET("/test/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+	req := httptest.NewRequest(http.MethodGet, "/test/ip", nil)
+	req.RemoteAddr = remote + ":40000"
+	req.Header.Set("X-Forwarded-For", forwarded)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	t.Setenv("DORM_TRUSTED_PROXIES", "")
+	if got := clientIP(t, "10.0.0.1", "203.0.113.5"); got != "10.0.0.1" {
+		t.Errorf("client IP %s, want the connection's address 10.0.0.1", got)
+	}
+}
+
+func TestClientIPWithTrustedProxy(t *testing.T) {
+	t.Setenv("DORM_TRUSTED_PROXIES", "10.0.0.0/8")
+	if got := clientIP(t, "10.0.0.1", "203.0.113.5"); got != "203.0.113.5" {
+		t.Errorf("behind a trusted proxy: client IP %s, want 203.0.113.5", got)
+	}
+	if got := clientIP(t, "198.51.100.7", "203.0.113.5"); got != "198.51.100.7" {
+		t.Errorf("from an untrusted address: client IP %s, want 198.51.100.7", got)
+	}
+}
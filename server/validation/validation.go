@@ -0,0 +1,271 @@
+// Package validation holds the field rules shared by the create, update and
+// import handlers.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+// FieldError describes one invalid field. Field is the JSON name.
+type FieldError struct {
+	Field   string        `json:"field"`
+	Code    errcode.Code  `json:"code"`
+	Message string        `json:"message"`
+	Args    []interface{} `json:"-"`
+}
+
+// Errors collects the field errors of one request. An empty Errors means
+// the request is valid.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Add records code for field with its Chinese message; Localize switches
+// the messages to the caller's language.
+func (e *Errors) Add(field string, code errcode.Code, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Code: code, Message: code.Message(errcode.LangZH, args...), Args: args})
+}
+
+// Localize returns a copy of e with the messages in lang.
+func (e Errors) Localize(lang string) Errors {
+	out := make(Errors, len(e))
+	for i, fe := range e {
+		fe.Message = fe.Code.Message(lang, fe.Args...)
+		out[i] = fe
+	}
+	return out
+}
+
+var (
+	// Student numbers are 8 to 12 digits, e.g. 20250123.
+	studentNoPattern = regexp.MustCompile(`^[0-9]{8,12}$`)
+	// A mainland mobile number, or a landline with an optional area code.
+	mobilePattern   = regexp.MustCompile(`^1[3-9][0-9]{9}$`)
+	landlinePattern = regexp.MustCompile(`^(0[0-9]{2,3}-?)?[0-9]{7,8}$`)
+	// Room numbers are the floor followed by a two digit index, e.g. 305.
+	roomNoPattern = regexp.MustCompile(`^[0-9]{3,4}$`)
+)
+
+func Required(errs *Errors, field, v string) {
+	if strings.TrimSpace(v) == "" {
+		errs.Add(field, errcode.Required)
+	}
+}
+
+func StudentNo(errs *Errors, field, v string) {
+	if !studentNoPattern.MatchString(v) {
+		errs.Add(field, errcode.InvalidStudentNo)
+	}
+}
+
+// Phone accepts an empty value; callers that need one use Required too.
+func Phone(errs *Errors, field, v string) {
+	if v == "" || mobilePattern.MatchString(v) || landlinePattern.MatchString(v) {
+		return
+	}
+	errs.Add(field, errcode.InvalidPhone)
+}
+
+// RoomNo checks that the floor encoded in a room number exists in a building
+// with floorCount floors.
+func RoomNo(errs *Errors, field, v string, floorCount int) {
+	if !roomNoPattern.MatchString(v) {
+		errs.Add(field, errcode.InvalidRoomNo)
+		return
+	}
+	floor, _ := strconv.Atoi(v[:len(v)-2])
+	if floor < 1 || floor > floorCount {
+		errs.Add(field, errcode.RoomFloorOutOfRange, floorCount)
+	}
+}
+
+func Building(b models.ApartmentBuilding) Errors {
+	var errs Errors
+	Required(&errs, "buildingNo", b.BuildingNo)
+	if b.FloorCount <= 0 {
+		errs.Add("floorCount", errcode.InvalidFloorCount)
+	}
+	if b.RoomCount < 0 {
+		errs.Add("roomCount", errcode.InvalidRoomCount)
+	}
+	return errs
+}
+
+// Room checks a new room r against the building it belongs to.
+func Room(r models.DormRoom, b models.ApartmentBuilding) Errors {
+	return room(r, b, nil)
+}
+
+// RoomUpdate checks r, the new state of old, against its building. The
+// room number and phone are only checked when they change, so that rooms
+// saved before the patterns existed can still be edited.
+func RoomUpdate(old, r models.DormRoom, b models.ApartmentBuilding) Errors {
+	return room(r, b, &old)
+}
+
+func room(r models.DormRoom, b models.ApartmentBuilding, old *models.DormRoom) Errors {
+	var errs Errors
+	if old == nil || r.RoomNo != old.RoomNo || r.BuildingID != old.BuildingID {
+		RoomNo(&errs, "roomNo", r.RoomNo, b.FloorCount)
+	}
+	if r.Capacity <= 0 {
+		errs.Add("capacity", errcode.InvalidRoomCapacity)
+	}
+	if r.Fee < 0 {
+		errs.Add("fee", errcode.InvalidRoomFee)
+	}
+	if old == nil || r.Phone != old.Phone {
+		Phone(&errs, "phone", r.Phone)
+	}
+	return errs
+}
+
+// Student checks a new student.
+func Student(s models.Student) Errors {
+	return student(s, nil)
+}
+
+// StudentUpdate checks s, the new state of old. Like RoomUpdate it only
+// checks the student number and phone when they change.
+func StudentUpdate(old, s models.Student) Errors {
+	return student(s, &old)
+}
+
+func student(s models.Student, old *models.Student) Errors {
+	var errs Errors
+	if old == nil || s.StudentNo != old.StudentNo {
+		StudentNo(&errs, "studentNo", s.StudentNo)
+	}
+	Required(&errs, "name", s.Name)
+	if s.Gender != "男" && s.Gender != "女" {
+		errs.Add("gender", errcode.InvalidGender)
+	}
+	if old == nil || s.Phone != old.Phone {
+		Phone(&errs, "phone", s.Phone)
+	}
+	return errs
+}
+
+func Payment(paymentNo, paymentType string, amount float64) Errors {
+	var errs Errors
+	Required(&errs, "paymentNo", paymentNo)
+	if !contains(models.FeeTypes, paymentType) {
+		errs.Add("paymentType", errcode.InvalidPaymentType)
+	}
+	if amount <= 0 {
+		errs.Add("amount", errcode.AmountNotPositive)
+	}
+	return errs
+}
+
+// Term checks a term's name and that its dates are in order.
+func Term(t models.Term) Errors {
+	var errs Errors
+	Required(&errs, "name", t.Name)
+	if t.EndDate.Before(t.StartDate) {
+		errs.Add("endDate", errcode.TermDatesInvalid)
+	}
+	return errs
+}
+
+// FeeSchedule checks a schedule's term, item, amount and target. A room
+// schedule names only the room; the others need a building or a room type.
+func FeeSchedule(fs models.FeeSchedule) Errors {
+	var errs Errors
+	if fs.TermID == 0 {
+		errs.Add("termID", errcode.Required)
+	}
+	if !contains(models.FeeTypes, fs.FeeType) {
+		errs.Add("feeType", errcode.InvalidPaymentType)
+	}
+	if fs.Amount < 0 {
+		errs.Add("amount", errcode.AmountNegative)
+	}
+	if fs.RoomID != nil {
+		if fs.BuildingID != nil || fs.RoomType != "" {
+			errs.Add("roomID", errcode.InvalidFeeScheduleTarget)
+		}
+	} else if fs.BuildingID == nil && fs.RoomType == "" {
+		errs.Add("buildingID", errcode.InvalidFeeScheduleTarget)
+	}
+	return errs
+}
+
+// DepositTransaction checks a refund or deduction. A deduction must say
+// what it is for.
+func DepositTransaction(d models.DepositTransaction) Errors {
+	var errs Errors
+	if d.Kind != models.DepositRefund && d.Kind != models.DepositDeduction {
+		errs.Add("kind", errcode.InvalidDepositKind)
+	}
+	if d.Kind == models.DepositDeduction {
+		Required(&errs, "description", d.Description)
+	}
+	if d.Amount <= 0 {
+		errs.Add("amount", errcode.AmountNotPositive)
+	}
+	return errs
+}
+
+// User checks the account fields. knownRole reports whether a role exists;
+// the role list lives with the permission matrix.
+func User(username, name, role string, knownRole func(string) bool) Errors {
+	var errs Errors
+	Required(&errs, "username", username)
+	Required(&errs, "name", name)
+	if !knownRole(role) {
+		errs.Add("role", errcode.UnknownRole)
+	}
+	return errs
+}
+
+// FromBindError turns a JSON decoding error into field errors where the
+// decoder says which field was wrong.
+func FromBindError(err error) Errors {
+	var errs Errors
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		errs.Add(typeErr.Field, typeCode(typeErr.Type.Kind().String()))
+	case errors.As(err, &syntaxErr):
+		errs.Add("", errcode.MalformedJSON)
+	default:
+		errs.Add("", errcode.InvalidRequest)
+	}
+	return errs
+}
+
+func typeCode(kind string) errcode.Code {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return errcode.ExpectedNumber
+	case kind == "bool":
+		return errcode.ExpectedBoolean
+	case kind == "string":
+		return errcode.ExpectedString
+	}
+	return errcode.InvalidType
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package validation
+
+import (
+	"testing"
+
+	"dormsystem/errcode"
+	"dormsystem/models"
+)
+
+// codes lists the codes recorded in errs, in order.
+func codes(errs Errors) []errcode.Code {
+	var out []errcode.Code
+	for _, fe := range errs {
+		out = append(out, fe.Code)
+	}
+	return out
+}
+
+func TestRoomNo(t *testing.T) {
+	tests := []struct {
+		roomNo string
+		floors int
+		want   errcode.Code
+	}{
+		{"305", 6, ""},
+		{"101", 1, ""},
+		{"1201", 12, ""},
+		{"612", 6, ""},
+		{"705", 6, errcode.RoomFloorOutOfRange},
+		{"005", 6, errcode.RoomFloorOutOfRange},
+		{"1301", 12, errcode.RoomFloorOutOfRange},
+		{"", 6, errcode.InvalidRoomNo},
+		{"30", 6, errcode.InvalidRoomNo},
+		{"12345", 6, errcode.InvalidRoomNo},
+		{"3A5", 6, errcode.InvalidRoomNo},
+		{"A305", 6, errcode.InvalidRoomNo},
+		{" 305", 6, errcode.InvalidRoomNo},
+	}
+	for _, tt := range tests {
+		var errs Errors
+		RoomNo(&errs, "roomNo", tt.roomNo, tt.floors)
+		if got := codes(errs); (tt.want == "" && len(got) != 0) || (tt.want != "" && (len(got) != 1 || got[0] != tt.want)) {
+			t.Errorf("RoomNo(%q, %d floors) = %v, want %q", tt.roomNo, tt.floors, got, tt.want)
+		}
+	}
+}
+
+func TestStudentNo(t *testing.T) {
+	tests := []struct {
+		studentNo string
+		ok        bool
+	}{
+		{"20250123", true},
+		{"202501230001", true},
+		{"2025012", false},
+		{"2025012300012", false},
+		{"2025O123", false},
+		{"", false},
+		{"20250123 ", false},
+	}
+	for _, tt := range tests {
+		var errs Errors
+		StudentNo(&errs, "studentNo", tt.studentNo)
+		if ok := len(errs) == 0; ok != tt.ok {
+			t.Errorf("StudentNo(%q): valid = %v, want %v", tt.studentNo, ok, tt.ok)
+		}
+	}
+}
+
+func TestPhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		ok    bool
+	}{
+		{"", true},
+		{"13812345678", true},
+		{"19912345678", true},
+		{"12812345678", false},
+		{"1381234567", false},
+		{"138123456789", false},
+		{"010-12345678", true},
+		{"01012345678", true},
+		{"0571-1234567", true},
+		{"12345678", true},
+		{"1234567", true},
+		{"123456", false},
+		{"10-12345678", false},
+		{"+8613812345678", false},
+		{"138-1234-5678", false},
+	}
+	for _, tt := range tests {
+		var errs Errors
+		Phone(&errs, "phone", tt.phone)
+		if ok := len(errs) == 0; ok != tt.ok {
+			t.Errorf("Phone(%q): valid = %v, want %v", tt.phone, ok, tt.ok)
+		}
+	}
+}
+
+func TestRoomUpdateKeepsLegacyValues(t *testing.T) {
+	b := models.ApartmentBuilding{ID: 1, FloorCount: 6}
+	old := models.DormRoom{BuildingID: 1, RoomNo: "A-12", Capacity: 4, Phone: "8888"}
+	r := old
+	r.Capacity = 6
+	if errs := RoomUpdate(old, r, b); len(errs) != 0 {
+		t.Fatalf("editing another field of a legacy room: %v", errs)
+	}
+	r.RoomNo = "A-13"
+	r.Phone = "9999"
+	got := codes(RoomUpdate(old, r, b))
+	if len(got) != 2 || got[0] != errcode.InvalidRoomNo || got[1] != errcode.InvalidPhone {
+		t.Errorf("changing the room number and phone: %v, want both rejected", got)
+	}
+	if errs := Room(old, b); len(errs) != 2 {
+		t.Errorf("creating a legacy room: %v, want the room number and phone rejected", errs)
+	}
+}
+
+func TestStudentUpdateKeepsLegacyValues(t *testing.T) {
+	old := models.Student{StudentNo: "S001", Name: "张三", Gender: "男", Phone: "n/a"}
+	s := old
+	s.Name = "张三丰"
+	if errs := StudentUpdate(old, s); len(errs) != 0 {
+		t.Fatalf("renaming a legacy student: %v", errs)
+	}
+	s.StudentNo = "S002"
+	if got := codes(StudentUpdate(old, s)); len(got) != 1 || got[0] != errcode.InvalidStudentNo {
+		t.Errorf("changing the student number: %v, want it rejected", got)
+	}
+}
@@ -9,9 +9,15 @@ export function createBuilding(data) {
 }
 
 export function updateBuilding(id, data) {
-  return http.put("/buildings/" + id, data);
+  return http.put("/buildings/" + id, data, {
+    headers: { "If-Match": '"' + data.version + '"' }
+  });
 }
 
-export function deleteBuilding(id) {
-  return http.delete("/buildings/" + id);
+export function deleteBuilding(id, params) {
+  return http.delete("/buildings/" + id, { params });
+}
+
+export function getBuildingDependencies(id) {
+  return http.get("/buildings/" + id + "/dependencies");
 }
@@ -1,7 +1,9 @@
 import axios from "axios";
 
+const baseURL = "http://localhost:8080/api";
+
 const http = axios.create({
-  baseURL: "http://localhost:8080/api"
+  baseURL
 });
 
 http.interceptors.request.use((config) => {
@@ -13,5 +15,65 @@ http.interceptors.request.use((config) => {
   return config;
 });
 
-export default http;
+export function saveTokens(data) {
+  localStorage.setItem("token", data.token);
+  if (data.refreshToken) {
+    localStorage.setItem("refreshToken", data.refreshToken);
+  }
+}
+
+export function clearTokens() {
+  localStorage.removeItem("token");
+  localStorage.removeItem("refreshToken");
+}
+
+let refreshing = null;
+
+const refreshTokens = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem("refreshToken");
+    refreshing = axios
+      .post(baseURL + "/token/refresh", { refreshToken })
+      .then((res) => saveTokens(res.data))
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+};
+
+const toLogin = () => {
+  clearTokens();
+  if (window.location.pathname !== "/login") {
+    window.location.href = "/login";
+  }
+};
 
+http.interceptors.response.use(
+  (res) => res,
+  async (err) => {
+    const config = err.config;
+    const data = err.response && err.response.data;
+    if (data && Array.isArray(data.fields) && data.fields.length) {
+      // Show the field errors in place of the generic message.
+      data.error = data.fields.map((f) => (f.field ? f.field + "：" : "") + f.message).join("；");
+    }
+    if (!err.response || err.response.status !== 401) {
+      return Promise.reject(err);
+    }
+    if (config._retried || !localStorage.getItem("refreshToken")) {
+      toLogin();
+      return Promise.reject(err);
+    }
+    config._retried = true;
+    try {
+      await refreshTokens();
+    } catch (e) {
+      toLogin();
+      return Promise.reject(err);
+    }
+    return http(config);
+  }
+);
+
+export default http;
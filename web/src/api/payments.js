@@ -8,10 +8,10 @@ export function createPayment(data) {
   return http.post("/payments", data);
 }
 
-export function updatePayment(id, data) {
-  return http.put("/payments/" + id, data);
+export function voidPayment(id, reason) {
+  return http.post("/payments/" + id + "/void", { reason });
 }
 
-export function deletePayment(id) {
-  return http.delete("/payments/" + id);
+export function reversePayment(id, data) {
+  return http.post("/payments/" + id + "/reverse", data);
 }
@@ -9,9 +9,15 @@ export function createRoom(data) {
 }
 
 export function updateRoom(id, data) {
-  return http.put("/rooms/" + id, data);
+  return http.put("/rooms/" + id, data, {
+    headers: { "If-Match": '"' + data.version + '"' }
+  });
 }
 
-export function deleteRoom(id) {
-  return http.delete("/rooms/" + id);
+export function deleteRoom(id, params) {
+  return http.delete("/rooms/" + id, { params });
+}
+
+export function getRoomDependencies(id) {
+  return http.get("/rooms/" + id + "/dependencies");
 }
@@ -9,7 +9,9 @@ export function createStudent(data) {
 }
 
 export function updateStudent(id, data) {
-  return http.put("/students/" + id, data);
+  return http.put("/students/" + id, data, {
+    headers: { "If-Match": '"' + data.version + '"' }
+  });
 }
 
 export function deleteStudent(id) {
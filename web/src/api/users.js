@@ -9,9 +9,31 @@ export function createUser(data) {
 }
 
 export function updateUser(id, data) {
-  return http.put("/users/" + id, data);
+  return http.put("/users/" + id, data, {
+    headers: { "If-Match": '"' + data.version + '"' }
+  });
 }
 
 export function deleteUser(id) {
   return http.delete("/users/" + id);
 }
+
+export function unlockUser(id) {
+  return http.post("/users/" + id + "/unlock");
+}
+
+export function resetUserTOTP(id) {
+  return http.post("/users/" + id + "/2fa/reset");
+}
+
+export function changePassword(data) {
+  return http.put("/me/password", data);
+}
+
+export function setupTOTP() {
+  return http.post("/me/2fa/setup");
+}
+
+export function enableTOTP(data) {
+  return http.post("/me/2fa/enable", data);
+}